@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// captureBackends lists the supported capture commands in the order "auto" probes them.
+var captureBackends = []string{"sox", "rec"}
+
+// cuePlayers lists the commands tried, in order, to play start/stop cues.
+var cuePlayers = []string{"afplay"}
+
+// notifyCommand returns the command that shows a notification through
+// Notification Center. The text is passed as script arguments, so it needs
+// no AppleScript quoting.
+func notifyCommand(summary, body string) (string, []string) {
+	return "osascript", []string{
+		"-e", "on run argv",
+		"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+		"-e", "end run",
+		summary, body,
+	}
+}
+
+// captureArgs returns the arguments that make backend write raw signed
+// 16-bit little-endian samples in config's format to stdout. rec always
+// records from the default input; -device needs the sox backend.
+func captureArgs(backend string, config AudioConfig) []string {
+	input := []string{"-d"}
+	if *device != "" {
+		input = []string{"-t", "coreaudio", *device}
+	}
+	if backend == "rec" {
+		input = nil
+	}
+
+	args := append([]string{"-q"}, input...)
+	return append(args, "-t", "raw", "-b", "16", "-e", "signed-integer", "-L",
+		"-r", strconv.Itoa(config.SampleRate), "-c", strconv.Itoa(config.Channels), "-")
+}
+
+// listDevices prints the available Core Audio devices.
+func listDevices() error {
+	cmd := exec.Command("system_profiler", "SPAudioDataType")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("listing devices: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// captureBackends lists the supported capture commands in the order "auto" probes them.
+var captureBackends = []string{"parec", "pw-record"}
+
+// cuePlayers lists the commands tried, in order, to play start/stop cues.
+var cuePlayers = []string{"paplay", "pw-play"}
+
+// notifyCommand returns the command that shows a desktop notification.
+func notifyCommand(summary, body string) (string, []string) {
+	return "notify-send", []string{"--app-name=WhisperType", "--urgency=critical", summary, body}
+}
+
+// captureArgs returns the arguments that make backend write raw signed
+// 16-bit little-endian samples in config's format to stdout.
+func captureArgs(backend string, config AudioConfig) []string {
+	if backend == "pw-record" {
+		args := []string{"--format=s16", fmt.Sprintf("--rate=%d", config.SampleRate), fmt.Sprintf("--channels=%d", config.Channels)}
+		if *device != "" {
+			args = append(args, "--target="+*device)
+		}
+		return append(args, "-")
+	}
+
+	args := []string{"--format=s16le", fmt.Sprintf("--rate=%d", config.SampleRate), fmt.Sprintf("--channels=%d", config.Channels)}
+	if *device != "" {
+		args = append(args, "--device="+*device)
+	}
+	return args
+}
+
+// listDevices prints the available PulseAudio sources.
+func listDevices() error {
+	cmd := exec.Command("pactl", "list", "short", "sources")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("listing sources: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+/*
+#cgo LDFLAGS: -framework ApplicationServices
+#include <ApplicationServices/ApplicationServices.h>
+
+// postUnicode types chars as a single key press carrying a Unicode string,
+// so no keycode lookup for the current layout is needed.
+static void postUnicode(UniChar *chars, int length) {
+	CGEventRef down = CGEventCreateKeyboardEvent(NULL, 0, true);
+	CGEventRef up = CGEventCreateKeyboardEvent(NULL, 0, false);
+	CGEventKeyboardSetUnicodeString(down, length, chars);
+	CGEventKeyboardSetUnicodeString(up, length, chars);
+	CGEventPost(kCGHIDEventTap, down);
+	CGEventPost(kCGHIDEventTap, up);
+	CFRelease(down);
+	CFRelease(up);
+}
+
+static void postKey(CGKeyCode code, CGEventFlags flags, bool keyDown) {
+	CGEventRef event = CGEventCreateKeyboardEvent(NULL, code, keyDown);
+	CGEventSetFlags(event, flags);
+	CGEventPost(kCGHIDEventTap, event);
+	CFRelease(event);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// namedKeys maps key names to macOS virtual keycodes (ANSI layout).
+var namedKeys = map[string]C.CGKeyCode{
+	"Return":    36,
+	"Tab":       48,
+	"BackSpace": 51,
+	"Escape":    53,
+	"Delete":    117,
+	"space":     49,
+	"Left":      123,
+	"Right":     124,
+
+	"a": 0, "s": 1, "d": 2, "f": 3, "h": 4, "g": 5, "z": 6, "x": 7, "c": 8,
+	"v": 9, "b": 11, "q": 12, "w": 13, "e": 14, "r": 15, "y": 16, "t": 17,
+	"o": 31, "u": 32, "i": 34, "p": 35, "l": 37, "j": 38, "k": 40, "n": 45,
+	"m": 46,
+
+	"1": 18, "2": 19, "3": 20, "4": 21, "6": 22, "5": 23, "9": 25, "7": 26,
+	"8": 28, "0": 29,
+}
+
+var modifierKeys = map[string]C.CGEventFlags{
+	"ctrl":  C.kCGEventFlagMaskControl,
+	"shift": C.kCGEventFlagMaskShift,
+	"alt":   C.kCGEventFlagMaskAlternate,
+	"cmd":   C.kCGEventFlagMaskCommand,
+}
+
+// setupInput returns the CoreGraphics typing backend. Global hotkeys aren't
+// supported on macOS, so the returned hotkeyInput is empty; recording is
+// toggled from the tray menu or the -api-port API instead.
+func setupInput() (TextTyper, hotkeyInput, error) {
+	if C.AXIsProcessTrusted() == 0 {
+		log.Printf("Warning: grant Accessibility access in System Settings, or typed text will be dropped")
+	}
+	log.Printf("Global hotkey %q is not supported on macOS; use the tray menu or -api-port", *hotkeySpec)
+
+	switch *outputMode {
+	case "type":
+		return &EventTyper{}, hotkeyInput{}, nil
+	default:
+		return nil, hotkeyInput{}, fmt.Errorf("output mode %q is not supported on macOS", *outputMode)
+	}
+}
+
+// EventTyper types text by posting CoreGraphics keyboard events.
+type EventTyper struct{}
+
+func (e *EventTyper) TypeText(text string) {
+	for _, char := range text {
+		units := utf16.Encode([]rune{char})
+		C.postUnicode((*C.UniChar)(unsafe.Pointer(&units[0])), C.int(len(units)))
+		time.Sleep(currentSettings().gap())
+	}
+}
+
+func (e *EventTyper) PressKey(spec string) error {
+	modifiers, key, err := parseKeySpec(spec)
+	if err != nil {
+		return err
+	}
+
+	var flags C.CGEventFlags
+	for _, modifier := range modifiers {
+		flags |= modifierKeys[modifier]
+	}
+	C.postKey(namedKeys[key], flags, true)
+	time.Sleep(currentSettings().keyDelay)
+	C.postKey(namedKeys[key], flags, false)
+	time.Sleep(currentSettings().gap())
+	return nil
+}
@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+)
+
+// setupInput returns the typing backend along with the -hotkey combination
+// and the optional undo, pause, safe mode and flush hotkeys, which are
+// grabbed on the root window. Wayland sessions type with wtype or ydotool
+// and only need the X server, usually XWayland, for the hotkeys: without
+// one they start with no global hotkeys, leaving the tray and -api-port.
+func setupInput() (TextTyper, hotkeyInput, error) {
+	var typer TextTyper
+	if os.Getenv("XDG_SESSION_TYPE") == "wayland" {
+		wayland, err := newWaylandTyper()
+		if err != nil {
+			return nil, hotkeyInput{}, err
+		}
+		log.Printf("Using Wayland typing backend: %s", wayland.command)
+		typer = wayland
+		if *outputMode == "paste" {
+			if typer, err = newWaylandPasteTyper(wayland); err != nil {
+				return nil, hotkeyInput{}, err
+			}
+		}
+	}
+
+	keyboard, err := newKeyboardSimulator()
+	if err != nil {
+		if typer == nil {
+			return nil, hotkeyInput{}, err
+		}
+		log.Printf("Global hotkeys disabled, use the tray menu or -api-port: %v", err)
+		return typer, hotkeyInput{}, nil
+	}
+
+	if typer == nil {
+		typer, err = newTextTyper(keyboard)
+		if err != nil {
+			return nil, hotkeyInput{}, err
+		}
+	}
+	if err := enableDetectableAutoRepeat(keyboard.conn); err != nil {
+		debugf("Held hotkeys repeat as release and press pairs: %v", err)
+	}
+
+	hotkey, err := parseHotkey(*hotkeySpec, keyboard)
+	if err != nil {
+		log.Printf("Invalid hotkey, falling back to %s: %v", defaultHotkey, err)
+		hotkey, err = parseHotkey(defaultHotkey, keyboard)
+		if err != nil {
+			return nil, hotkeyInput{}, err
+		}
+	}
+
+	undo := parseOptionalHotkey("undo", *undoSpec, keyboard)
+	pause := parseOptionalHotkey("pause", *pauseSpec, keyboard)
+	safe := parseOptionalHotkey("safe mode", *safeSpec, keyboard)
+	flush := parseOptionalHotkey("flush", *flushSpec, keyboard)
+
+	// The caller grabs the hotkeys, and grabs them again periodically:
+	// that is harmless while the grabs are still held, and recovers them
+	// once another client that took the keys lets go.
+	root := xproto.Setup(keyboard.conn).DefaultScreen(keyboard.conn).Root
+	var undoLost, pauseLost, safeLost, flushLost bool
+	grabOptional := func(name string, hotkey *Hotkey, wasLost *bool) {
+		if hotkey == nil {
+			return
+		}
+		err := grabHotkey(keyboard.conn, root, *hotkey)
+		if lost := err != nil; lost != *wasLost {
+			*wasLost = lost
+			if lost {
+				log.Printf("Warning: %s hotkey is unavailable: %v", name, err)
+			}
+		}
+	}
+	regrab := func() error {
+		grabOptional("undo", undo, &undoLost)
+		grabOptional("pause", pause, &pauseLost)
+		grabOptional("safe mode", safe, &safeLost)
+		grabOptional("flush", flush, &flushLost)
+		return grabHotkey(keyboard.conn, root, hotkey)
+	}
+
+	events := make(chan hotkeyEvent)
+	go func() {
+		// Press times of keys not yet released, to drop auto-repeats
+		pressedAt := make(map[xproto.Keycode]xproto.Timestamp)
+		for {
+			ev, err := keyboard.conn.WaitForEvent()
+			if err != nil {
+				continue
+			}
+			switch event := ev.(type) {
+			case xproto.MappingNotifyEvent:
+				keyboard.handleMappingNotify(event)
+			case xproto.KeyPressEvent:
+				last, held := pressedAt[event.Detail]
+				pressedAt[event.Detail] = event.Time
+				if held && time.Duration(event.Time-last)*time.Millisecond < autoRepeatWindow {
+					continue
+				}
+
+				// Check the optional hotkeys first: they may share a key with the
+				// recording hotkey, which matches on keycode alone.
+				if undo.matches(event) {
+					events <- hotkeyEvent{pressed: true, undo: true}
+				} else if pause.matches(event) {
+					events <- hotkeyEvent{pressed: true, pause: true}
+				} else if safe.matches(event) {
+					events <- hotkeyEvent{pressed: true, safe: true}
+				} else if flush.matches(event) {
+					events <- hotkeyEvent{pressed: true, flush: true}
+				} else if event.Detail == hotkey.keycode {
+					events <- hotkeyEvent{pressed: true}
+				}
+			case xproto.KeyReleaseEvent:
+				delete(pressedAt, event.Detail)
+				if event.Detail == hotkey.keycode {
+					events <- hotkeyEvent{pressed: false}
+				}
+			}
+		}
+	}()
+	return typer, hotkeyInput{events: events, regrab: regrab}, nil
+}
+
+// autoRepeatWindow is how soon after a key's last press another press,
+// without a release in between, counts as auto-repeat. Auto-repeat starts
+// well within it and then repeats faster, while a press arriving later means
+// the release was lost, e.g. to a grab, and the key was pressed again.
+const autoRepeatWindow = time.Second
+
+// XKB's device spec for the core keyboard, and its per-client flag making a
+// held key repeat presses without the releases in between.
+const (
+	xkbUseCoreKeyboard      = 0x100
+	xkbDetectableAutoRepeat = 1
+)
+
+// xkbTimeout bounds the wait for each XKB reply. xgb drops errors from
+// extensions it has no bindings for, so a failed request never completes.
+const xkbTimeout = time.Second
+
+// enableDetectableAutoRepeat asks XKB to report a held key as repeated
+// presses without releases, so the event loop can tell them from new
+// presses. xgb has no XKB bindings, so the UseExtension and PerClientFlags
+// requests are built by hand.
+func enableDetectableAutoRepeat(conn *xgb.Conn) error {
+	const name = "XKEYBOARD"
+	ext, err := xproto.QueryExtension(conn, uint16(len(name)), name).Reply()
+	if err != nil {
+		return fmt.Errorf("querying XKB extension: %w", err)
+	}
+	if !ext.Present {
+		return fmt.Errorf("XKB extension not present")
+	}
+
+	// UseExtension, asking for version 1.0
+	use := make([]byte, 8)
+	use[0], use[1] = ext.MajorOpcode, 0
+	xgb.Put16(use[2:], uint16(len(use)/4))
+	xgb.Put16(use[4:], 1)
+	reply, err := xkbRequest(conn, use)
+	if err != nil {
+		return fmt.Errorf("enabling XKB: %w", err)
+	}
+	if reply[1] == 0 {
+		return fmt.Errorf("XKB 1.0 not supported")
+	}
+
+	// PerClientFlags, changing and setting only DetectableAutoRepeat
+	flags := make([]byte, 28)
+	flags[0], flags[1] = ext.MajorOpcode, 21
+	xgb.Put16(flags[2:], uint16(len(flags)/4))
+	xgb.Put16(flags[4:], xkbUseCoreKeyboard)
+	xgb.Put32(flags[8:], xkbDetectableAutoRepeat)
+	xgb.Put32(flags[12:], xkbDetectableAutoRepeat)
+	reply, err = xkbRequest(conn, flags)
+	if err != nil {
+		return fmt.Errorf("setting XKB per-client flags: %w", err)
+	}
+	if xgb.Get32(reply[12:])&xkbDetectableAutoRepeat == 0 {
+		return fmt.Errorf("detectable auto-repeat not supported")
+	}
+	return nil
+}
+
+// xkbRequest sends request, which must have a reply, and returns the reply.
+func xkbRequest(conn *xgb.Conn, request []byte) ([]byte, error) {
+	cookie := conn.NewCookie(true, true)
+	conn.NewRequest(request, cookie)
+
+	type result struct {
+		reply []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := cookie.Reply()
+		done <- result{reply, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if len(r.reply) < 32 {
+			return nil, fmt.Errorf("short reply")
+		}
+		return r.reply, nil
+	case <-time.After(xkbTimeout):
+		return nil, fmt.Errorf("no reply after %v", xkbTimeout)
+	}
+}
+
+// parseOptionalHotkey parses spec for the named hotkey, returning nil when it
+// is empty or invalid, which disables the hotkey.
+func parseOptionalHotkey(name, spec string, keyboard *KeyboardSimulator) *Hotkey {
+	if spec == "" {
+		return nil
+	}
+	hotkey, err := parseHotkey(spec, keyboard)
+	if err != nil {
+		log.Printf("Invalid %s hotkey, %s disabled: %v", name, name, err)
+		return nil
+	}
+	return &hotkey
+}
+
+// matches reports whether event presses hotkey with exactly its modifiers.
+// A nil hotkey matches nothing.
+func (h *Hotkey) matches(event xproto.KeyPressEvent) bool {
+	return h != nil && event.Detail == h.keycode && event.State&hotkeyModifierMask == h.modifiers
+}
+
+// hotkeyModifierMask selects the modifiers a Hotkey can require from a key
+// event's state, ignoring CapsLock and NumLock.
+const hotkeyModifierMask = xproto.ModMaskShift | xproto.ModMaskControl | xproto.ModMask1 | xproto.ModMask4
+
+// grabHotkey grabs hotkey on root regardless of the CapsLock and NumLock
+// state. It returns an error only if no variant could be grabbed, usually
+// because another client holds the key combination.
+func grabHotkey(conn *xgb.Conn, root xproto.Window, hotkey Hotkey) error {
+	// Setup key monitoring for all possible modifier combinations
+	modifiers := []uint16{
+		hotkey.modifiers,                                        // Base modifiers
+		hotkey.modifiers | xproto.ModMaskLock,                   // With CapsLock
+		hotkey.modifiers | xproto.ModMask2,                      // With NumLock
+		hotkey.modifiers | xproto.ModMaskLock | xproto.ModMask2, // Both
+	}
+
+	var failed int
+	var lastErr error
+	for _, mod := range modifiers {
+		err := xproto.GrabKeyChecked(
+			conn,
+			false,
+			root,
+			mod,
+			hotkey.keycode,
+			xproto.GrabModeAsync,
+			xproto.GrabModeAsync,
+		).Check()
+		if err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	if failed == len(modifiers) {
+		return fmt.Errorf("failed to grab hotkey: %w", lastErr)
+	}
+	if failed > 0 {
+		debugf("Hotkey grabbed in only %d of %d lock states: %v", len(modifiers)-failed, len(modifiers), lastErr)
+	}
+	return nil
+}
+
+// defaultHotkey is used when the -hotkey flag cannot be parsed. Like any
+// hotkey its key is looked up in the current layout, not assumed to be at
+// the keycode it has on QWERTY.
+const defaultHotkey = "super+shift+a"
+
+// Hotkey is a key combination that toggles recording.
+type Hotkey struct {
+	keycode   xproto.Keycode
+	modifiers uint16
+}
+
+// hotkeyKeysyms maps the names of keys that don't type a character, in
+// lower case, to their keysyms. F1 to F24 are added by init.
+var hotkeyKeysyms = map[string]xproto.Keysym{
+	"space":       0x20,
+	"return":      0xff0d,
+	"tab":         0xff09,
+	"backspace":   0xff08,
+	"escape":      0xff1b,
+	"delete":      0xffff,
+	"insert":      0xff63,
+	"home":        0xff50,
+	"end":         0xff57,
+	"prior":       0xff55,
+	"next":        0xff56,
+	"pause":       0xff13,
+	"scroll_lock": 0xff14,
+	"print":       0xff61,
+	"menu":        0xff67,
+}
+
+func init() {
+	for n := 1; n <= 24; n++ {
+		hotkeyKeysyms[fmt.Sprintf("f%d", n)] = xproto.Keysym(0xffbe + n - 1)
+	}
+}
+
+// parseHotkey parses a spec like "super+shift+a" or "ctrl+F9" into a keycode
+// and modifier mask. The key, a character or a name from hotkeyKeysyms, is
+// looked up in the keyboard's current layout.
+func parseHotkey(spec string, keyboard *KeyboardSimulator) (Hotkey, error) {
+	modifierMasks := map[string]uint16{
+		"shift": xproto.ModMaskShift,
+		"ctrl":  xproto.ModMaskControl,
+		"alt":   xproto.ModMask1,
+		"super": xproto.ModMask4,
+	}
+
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(spec)), "+")
+	if len(parts) < 2 {
+		return Hotkey{}, fmt.Errorf("hotkey %q needs at least one modifier and a key", spec)
+	}
+
+	var hotkey Hotkey
+	for _, name := range parts[:len(parts)-1] {
+		mask, ok := modifierMasks[strings.TrimSpace(name)]
+		if !ok {
+			return Hotkey{}, fmt.Errorf("unknown modifier %q in hotkey %q", name, spec)
+		}
+		hotkey.modifiers |= mask
+	}
+
+	key := strings.TrimSpace(parts[len(parts)-1])
+	var (
+		keycode byte
+		found   bool
+	)
+	if keysym, ok := hotkeyKeysyms[key]; ok {
+		keycode, found = keyboard.keycodeForKeysym(keysym)
+	} else if runes := []rune(key); len(runes) == 1 {
+		keyboard.mu.Lock()
+		var stroke keyStroke
+		stroke, found = keyboard.keymap[runes[0]]
+		keycode = stroke.keycode
+		keyboard.mu.Unlock()
+	} else {
+		return Hotkey{}, fmt.Errorf("unknown key %q in hotkey %q", key, spec)
+	}
+	if !found {
+		return Hotkey{}, fmt.Errorf("key %q in hotkey %q is not on the current keyboard layout", key, spec)
+	}
+	hotkey.keycode = xproto.Keycode(keycode)
+
+	return hotkey, nil
+}
+
+// namedKey describes a key usable in key specs.
+type namedKey struct {
+	keysym xproto.Keysym // X11 keysym
+	evdev  int           // Linux input event code used by ydotool
+}
+
+// namedKeys maps key names, which are X keysym names as accepted by wtype,
+// to their codes. Letters and digits are added by init.
+var namedKeys = map[string]namedKey{
+	"Return":    {keysym: 0xff0d, evdev: 28},
+	"Tab":       {keysym: 0xff09, evdev: 15},
+	"BackSpace": {keysym: 0xff08, evdev: 14},
+	"Escape":    {keysym: 0xff1b, evdev: 1},
+	"Delete":    {keysym: 0xffff, evdev: 111},
+	"space":     {keysym: 0x20, evdev: 57},
+	"Left":      {keysym: 0xff51, evdev: 105},
+	"Right":     {keysym: 0xff53, evdev: 106},
+}
+
+func init() {
+	// Linux input event codes follow the physical QWERTY rows
+	rows := []struct {
+		keys  string
+		first int
+	}{
+		{"1234567890", 2},
+		{"qwertyuiop", 16},
+		{"asdfghjkl", 30},
+		{"zxcvbnm", 44},
+	}
+	for _, row := range rows {
+		for i, char := range row.keys {
+			namedKeys[string(char)] = namedKey{keysym: xproto.Keysym(char), evdev: row.first + i}
+		}
+	}
+}
+
+// modifierKey describes a modifier usable in key specs.
+type modifierKey struct {
+	keysym  xproto.Keysym // Left-hand key, looked up in the keymap
+	keycode byte          // Usual X11 keycode, used when the keymap has none
+	evdev   int           // Linux input event code used by ydotool
+}
+
+var modifierKeys = map[string]modifierKey{
+	"ctrl":  {keysym: 0xffe3, keycode: 37, evdev: 29}, // Control_L
+	"shift": {keysym: 0xffe1, keycode: 50, evdev: 42}, // Shift_L
+	"alt":   {keysym: 0xffe9, keycode: 64, evdev: 56}, // Alt_L
+}
+
+// WaylandTyper types text by shelling out to wtype or ydotool. Both accept
+// UTF-8 directly, so no keysym lookup is needed.
+type WaylandTyper struct {
+	command string
+}
+
+func newWaylandTyper() (*WaylandTyper, error) {
+	for _, command := range []string{"wtype", "ydotool"} {
+		if _, err := exec.LookPath(command); err == nil {
+			return &WaylandTyper{command: command}, nil
+		}
+	}
+	return nil, fmt.Errorf("no Wayland typing tool found (tried wtype, ydotool)")
+}
+
+func (w *WaylandTyper) TypeText(text string) {
+	gapMillis := strconv.FormatInt(currentSettings().gap().Milliseconds(), 10)
+	var cmd *exec.Cmd
+	switch w.command {
+	case "ydotool":
+		cmd = exec.Command("ydotool", "type", "--key-delay", gapMillis, "--", text)
+	default:
+		cmd = exec.Command("wtype", "-d", gapMillis, "--", text)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Failed to type with %s: %v: %s", w.command, err, strings.TrimSpace(string(output)))
+	}
+}
+
+func (w *WaylandTyper) PressKey(spec string) error {
+	modifiers, key, err := parseKeySpec(spec)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch w.command {
+	case "ydotool":
+		var args []string
+		for _, modifier := range modifiers {
+			args = append(args, fmt.Sprintf("%d:1", modifierKeys[modifier].evdev))
+		}
+		code := namedKeys[key].evdev
+		args = append(args, fmt.Sprintf("%d:1", code), fmt.Sprintf("%d:0", code))
+		for i := len(modifiers) - 1; i >= 0; i-- {
+			args = append(args, fmt.Sprintf("%d:0", modifierKeys[modifiers[i]].evdev))
+		}
+		cmd = exec.Command("ydotool", append([]string{"key"}, args...)...)
+	default:
+		var args []string
+		for _, modifier := range modifiers {
+			args = append(args, "-M", modifier)
+		}
+		args = append(args, "-k", key)
+		for _, modifier := range modifiers {
+			args = append(args, "-m", modifier)
+		}
+		cmd = exec.Command("wtype", args...)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pressing %s with %s: %w: %s", spec, w.command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// WaylandPasteTyper is PasteTyper for Wayland: it places text on the
+// clipboard with wl-copy and presses Ctrl+V with the Wayland typing tool.
+type WaylandPasteTyper struct {
+	*WaylandTyper
+}
+
+func newWaylandPasteTyper(typer *WaylandTyper) (*WaylandPasteTyper, error) {
+	for _, command := range []string{"wl-copy", "wl-paste"} {
+		if _, err := exec.LookPath(command); err != nil {
+			return nil, fmt.Errorf("paste output on Wayland requires %s: %w", command, err)
+		}
+	}
+	return &WaylandPasteTyper{WaylandTyper: typer}, nil
+}
+
+func (p *WaylandPasteTyper) TypeText(text string) {
+	// As with xclip, saving fails when the clipboard is empty
+	previous, saveErr := exec.Command("wl-paste", "--no-newline").Output()
+
+	if err := setWaylandClipboard(text); err != nil {
+		log.Printf("Failed to set clipboard: %v", err)
+		return
+	}
+	if err := p.PressKey("ctrl+v"); err != nil {
+		log.Printf("Failed to paste: %v", err)
+		return
+	}
+
+	if saveErr != nil {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := setWaylandClipboard(string(previous)); err != nil {
+		log.Printf("Failed to restore clipboard: %v", err)
+	}
+}
+
+// setWaylandClipboard replaces the clipboard contents using wl-copy.
+func setWaylandClipboard(text string) error {
+	cmd := exec.Command("wl-copy")
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+// PasteTyper outputs text by placing it on the clipboard with xclip and
+// simulating a single Ctrl+V, restoring the previous clipboard afterwards.
+type PasteTyper struct {
+	keyboard *KeyboardSimulator
+}
+
+func newPasteTyper(keyboard *KeyboardSimulator) (*PasteTyper, error) {
+	if _, err := exec.LookPath("xclip"); err != nil {
+		return nil, fmt.Errorf("paste output requires xclip: %w", err)
+	}
+	if _, ok := keyboard.keycodeForKeysym('v'); !ok {
+		return nil, fmt.Errorf("paste output requires a keycode for 'v'")
+	}
+	return &PasteTyper{keyboard: keyboard}, nil
+}
+
+func (p *PasteTyper) TypeText(text string) {
+	// Save the current clipboard so it can be restored after pasting. This
+	// fails when the clipboard is empty, in which case there's nothing to restore.
+	previous, saveErr := exec.Command("xclip", "-selection", "clipboard", "-o").Output()
+
+	if err := setClipboard(text); err != nil {
+		log.Printf("Failed to set clipboard: %v", err)
+		return
+	}
+
+	k := p.keyboard
+	vCode, _ := k.keycodeForKeysym('v')
+	ctrl := k.modifierKeycode("ctrl")
+	k.keys.keyPress(ctrl)
+	k.keys.keyPress(vCode)
+	time.Sleep(currentSettings().keyDelay)
+	k.keys.keyRelease(vCode)
+	k.keys.keyRelease(ctrl)
+
+	if saveErr != nil {
+		return
+	}
+
+	// Give the target application time to request the selection before
+	// handing ownership back to the previous contents.
+	time.Sleep(100 * time.Millisecond)
+	if err := setClipboard(string(previous)); err != nil {
+		log.Printf("Failed to restore clipboard: %v", err)
+	}
+}
+
+func (p *PasteTyper) PressKey(spec string) error {
+	return p.keyboard.PressKey(spec)
+}
+
+func (p *PasteTyper) FocusedClass() (string, string, error) {
+	return p.keyboard.FocusedClass()
+}
+
+func (p *PasteTyper) FocusedTitle() (string, error) {
+	return p.keyboard.FocusedTitle()
+}
+
+// setClipboard replaces the clipboard contents using xclip.
+func setClipboard(text string) error {
+	return setSelection("clipboard", text)
+}
+
+// setSelection replaces the contents of an X selection, such as clipboard
+// or primary, using xclip.
+func setSelection(selection, text string) error {
+	cmd := exec.Command("xclip", "-selection", selection)
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+// newTextTyper picks an X typing backend based on the -output flag.
+func newTextTyper(keyboard *KeyboardSimulator) (TextTyper, error) {
+	switch *outputMode {
+	case "type":
+		if *verifyType {
+			if _, err := exec.LookPath("xclip"); err != nil {
+				log.Printf("Warning: -verify-typing needs xclip to read typed text back: %v", err)
+			}
+		}
+		return keyboard, nil
+	case "paste":
+		return newPasteTyper(keyboard)
+	default:
+		return nil, fmt.Errorf("unknown output mode %q", *outputMode)
+	}
+}
+
+type KeyboardSimulator struct {
+	conn *xgb.Conn
+	keys keySender
+
+	// mu guards the mapping state below, which is rebuilt when the layout
+	// changes while typing may be in progress.
+	mu        sync.Mutex
+	keymap    map[rune]keyStroke
+	keysyms   map[xproto.Keysym]byte
+	modifiers map[string]byte // Keycode of each of modifierKeys
+
+	// Keycodes with no keysyms, rebound on demand to type runes missing from
+	// keymap. remapped caches which rune each one currently produces.
+	keysymsPerCode byte
+	spareKeycodes  []byte
+	nextSpare      int
+	remapped       map[rune]byte
+}
+
+// keyStroke is how to type a character on the current layout: the keycode
+// and whether Shift is held while pressing it.
+type keyStroke struct {
+	keycode byte
+	shift   bool
+}
+
+// keySender sends synthetic key events. KeyboardSimulator sends every press
+// and release through one, so tests can record the sequence instead.
+type keySender interface {
+	keyPress(keycode byte)
+	keyRelease(keycode byte)
+}
+
+// xtestSender sends key events to the X server with XTEST.
+type xtestSender struct {
+	conn *xgb.Conn
+}
+
+func (x xtestSender) keyPress(keycode byte) {
+	xtest.FakeInput(x.conn, xproto.KeyPress, keycode, 0, 0, 0, 0, 0)
+}
+
+func (x xtestSender) keyRelease(keycode byte) {
+	xtest.FakeInput(x.conn, xproto.KeyRelease, keycode, 0, 0, 0, 0, 0)
+}
+
+func newKeyboardSimulator() (*KeyboardSimulator, error) {
+	X, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to X server: %w", err)
+	}
+
+	if err := xtest.Init(X); err != nil {
+		X.Close()
+		return nil, fmt.Errorf("initializing XTEST: %w", err)
+	}
+
+	// Get keyboard mapping
+	keyboard := &KeyboardSimulator{conn: X, keys: xtestSender{X}}
+	if err := keyboard.initKeymap(); err != nil {
+		X.Close()
+		return nil, fmt.Errorf("initializing keymap: %w", err)
+	}
+
+	return keyboard, nil
+}
+
+func (k *KeyboardSimulator) initKeymap() error {
+	// Query the server for the first keycode
+	setup := xproto.Setup(k.conn)
+	mapping, err := xproto.GetKeyboardMapping(k.conn,
+		setup.MinKeycode,
+		byte(setup.MaxKeycode-setup.MinKeycode+1)).Reply()
+	if err != nil {
+		return fmt.Errorf("getting keyboard mapping: %w", err)
+	}
+
+	k.setKeymap(byte(setup.MinKeycode), mapping.KeysymsPerKeycode, mapping.Keysyms)
+	return nil
+}
+
+// setKeymap replaces the keymap with one built from a keyboard mapping
+// starting at minKeycode. Keycodes rebound by remap are forgotten, since
+// the new mapping lists them as they are now.
+func (k *KeyboardSimulator) setKeymap(minKeycode, keysPerCode byte, keysyms []xproto.Keysym) {
+	k.keymap, k.keysyms, k.spareKeycodes = buildKeymap(minKeycode, int(keysPerCode), keysyms)
+	k.modifiers = make(map[string]byte, len(modifierKeys))
+	for name, modifier := range modifierKeys {
+		keycode, ok := k.keysyms[modifier.keysym]
+		if !ok {
+			log.Printf("No key for %s in the keyboard mapping, using keycode %d", name, modifier.keycode)
+			keycode = modifier.keycode
+		}
+		k.modifiers[name] = keycode
+	}
+	k.remapped = make(map[rune]byte)
+	k.nextSpare = 0
+	k.keysymsPerCode = keysPerCode
+}
+
+// handleMappingNotify rebuilds the keymap after another client changes the
+// keyboard mapping, e.g. setxkbmap switching layouts. Notifications for a
+// single spare keycode come from remap and ResetRemaps and are ignored.
+func (k *KeyboardSimulator) handleMappingNotify(event xproto.MappingNotifyEvent) {
+	if event.Request != xproto.MappingKeyboard {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if event.Count == 1 && slices.Contains(k.spareKeycodes, byte(event.FirstKeycode)) {
+		return
+	}
+	if err := k.initKeymap(); err != nil {
+		log.Printf("Failed to rebuild keymap after mapping change: %v", err)
+		return
+	}
+	log.Printf("Keyboard mapping changed, rebuilt keymap")
+}
+
+// strokeFor returns the keystroke that types char, remapping a spare
+// keycode when the layout has none. Remapped keycodes produce char at every
+// level, so they never need Shift.
+func (k *KeyboardSimulator) strokeFor(char rune) (keyStroke, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if stroke, ok := k.keymap[char]; ok {
+		return stroke, nil
+	}
+	keycode, err := k.remap(char)
+	if err != nil {
+		return keyStroke{}, err
+	}
+	return keyStroke{keycode: keycode}, nil
+}
+
+// modifierKeycode returns the keycode of a modifier in modifierKeys.
+func (k *KeyboardSimulator) modifierKeycode(name string) byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.modifiers[name]
+}
+
+// keycodeForKeysym returns the first keycode bound to keysym.
+func (k *KeyboardSimulator) keycodeForKeysym(keysym xproto.Keysym) (byte, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keycode, ok := k.keysyms[keysym]
+	return keycode, ok
+}
+
+// buildKeymap indexes a keyboard mapping starting at minKeycode. It returns
+// the keystroke producing each character, the first keycode for each keysym
+// (used for named keys), and the keycodes with no keysyms bound.
+//
+// Characters are taken from the first two levels of the first group, typed
+// without and with Shift, so layouts such as AZERTY, where digits are
+// shifted, come out right. A character on both levels or several keys is
+// typed the unshifted way where possible. Characters only on other levels,
+// such as AltGr ones, are left out, so they are typed by remapping.
+func buildKeymap(minKeycode byte, keysPerCode int, keysyms []xproto.Keysym) (map[rune]keyStroke, map[xproto.Keysym]byte, []byte) {
+	keymap := make(map[rune]keyStroke)
+	firstCodes := make(map[xproto.Keysym]byte)
+	var spare []byte
+	if keysPerCode == 0 {
+		return keymap, firstCodes, spare
+	}
+
+	for i := 0; i < len(keysyms)/keysPerCode; i++ {
+		keycode := byte(int(minKeycode) + i)
+		levels := keysyms[i*keysPerCode : (i+1)*keysPerCode]
+		unused := true
+		for _, keysym := range levels {
+			if keysym == 0 {
+				continue
+			}
+			unused = false
+
+			if _, ok := firstCodes[keysym]; !ok {
+				firstCodes[keysym] = keycode
+			}
+		}
+
+		for shift, char := range levelRunes(levels) {
+			if char == 0 {
+				continue
+			}
+			if stroke, ok := keymap[char]; !ok || stroke.shift && shift == 0 {
+				keymap[char] = keyStroke{keycode: keycode, shift: shift == 1}
+			}
+		}
+
+		if unused {
+			spare = append(spare, keycode)
+		}
+	}
+	return keymap, firstCodes, spare
+}
+
+// levelRunes returns the characters a key types without and with Shift, 0
+// for none. As the core protocol specifies, a key listing only a letter
+// types its lowercase form unshifted and its uppercase form shifted.
+func levelRunes(levels []xproto.Keysym) [2]rune {
+	var chars [2]rune
+	if len(levels) > 0 {
+		chars[0] = keysymToRune(levels[0])
+	}
+	if len(levels) > 1 && levels[1] != 0 {
+		chars[1] = keysymToRune(levels[1])
+	} else if lower, upper := unicode.ToLower(chars[0]), unicode.ToUpper(chars[0]); lower != upper {
+		chars[0], chars[1] = lower, upper
+	} else {
+		chars[1] = chars[0]
+	}
+	return chars
+}
+
+// remap binds a spare keycode to the keysym for char so it can be typed even
+// though no key produces it. Bindings are cached until ResetRemaps, and the
+// oldest binding is reused once every spare keycode is taken. Callers hold
+// k.mu.
+func (k *KeyboardSimulator) remap(char rune) (byte, error) {
+	if keycode, ok := k.remapped[char]; ok {
+		return keycode, nil
+	}
+	if len(k.spareKeycodes) == 0 {
+		return 0, fmt.Errorf("no spare keycodes to remap")
+	}
+
+	keycode := k.spareKeycodes[k.nextSpare]
+	k.nextSpare = (k.nextSpare + 1) % len(k.spareKeycodes)
+	for r, code := range k.remapped {
+		if code == keycode {
+			delete(k.remapped, r)
+		}
+	}
+
+	// Bind every level to the keysym so modifier state doesn't matter
+	keysyms := make([]xproto.Keysym, k.keysymsPerCode)
+	for i := range keysyms {
+		keysyms[i] = runeToKeysym(char)
+	}
+	if err := k.setMapping(keycode, keysyms); err != nil {
+		return 0, err
+	}
+	k.remapped[char] = keycode
+
+	// Give clients time to process the MappingNotify before typing
+	time.Sleep(20 * time.Millisecond)
+	return keycode, nil
+}
+
+// ResetRemaps restores every keycode rebound by remap to having no keysyms.
+func (k *KeyboardSimulator) ResetRemaps() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	empty := make([]xproto.Keysym, k.keysymsPerCode)
+	for char, keycode := range k.remapped {
+		if err := k.setMapping(keycode, empty); err != nil {
+			log.Printf("Failed to restore keycode %d: %v", keycode, err)
+		}
+		delete(k.remapped, char)
+	}
+}
+
+func (k *KeyboardSimulator) setMapping(keycode byte, keysyms []xproto.Keysym) error {
+	err := xproto.ChangeKeyboardMappingChecked(k.conn, 1, xproto.Keycode(keycode), k.keysymsPerCode, keysyms).Check()
+	if err != nil {
+		return fmt.Errorf("changing keyboard mapping: %w", err)
+	}
+	return nil
+}
+
+// runeToKeysym returns the keysym for a rune: Latin-1 runes map directly and
+// everything else uses the Unicode keysym range.
+func runeToKeysym(r rune) xproto.Keysym {
+	if r < 0x100 {
+		return xproto.Keysym(r)
+	}
+	return xproto.Keysym(0x1000000 + r)
+}
+
+// legacyKeysyms maps the pre-Unicode keysyms for non-Latin-1 characters
+// that layouts still bind, so those characters type without a remap.
+var legacyKeysyms = map[xproto.Keysym]rune{
+	// Latin-2
+	0x1a1: 'Ą', 0x1a3: 'Ł', 0x1a5: 'Ľ', 0x1a6: 'Ś', 0x1a9: 'Š', 0x1aa: 'Ş',
+	0x1ab: 'Ť', 0x1ac: 'Ź', 0x1ae: 'Ž', 0x1af: 'Ż', 0x1b1: 'ą', 0x1b3: 'ł',
+	0x1b5: 'ľ', 0x1b6: 'ś', 0x1b9: 'š', 0x1ba: 'ş', 0x1bb: 'ť',
+	0x1bc: 'ź', 0x1be: 'ž', 0x1bf: 'ż', 0x1c0: 'Ŕ', 0x1c3: 'Ă', 0x1c5: 'Ĺ',
+	0x1c6: 'Ć', 0x1c8: 'Č', 0x1ca: 'Ę', 0x1cc: 'Ě', 0x1cf: 'Ď', 0x1d0: 'Đ',
+	0x1d1: 'Ń', 0x1d2: 'Ň', 0x1d5: 'Ő', 0x1d8: 'Ř', 0x1d9: 'Ů', 0x1db: 'Ű',
+	0x1de: 'Ţ', 0x1e0: 'ŕ', 0x1e3: 'ă', 0x1e5: 'ĺ', 0x1e6: 'ć', 0x1e8: 'č',
+	0x1ea: 'ę', 0x1ec: 'ě', 0x1ef: 'ď', 0x1f0: 'đ', 0x1f1: 'ń', 0x1f2: 'ň',
+	0x1f5: 'ő', 0x1f8: 'ř', 0x1f9: 'ů', 0x1fb: 'ű', 0x1fe: 'ţ',
+	// Cyrillic, laid out like KOI8-R
+	0x6a3: 'ё', 0x6b3: 'Ё', 0x6c0: 'ю', 0x6c1: 'а', 0x6c2: 'б', 0x6c3: 'ц',
+	0x6c4: 'д', 0x6c5: 'е', 0x6c6: 'ф', 0x6c7: 'г', 0x6c8: 'х', 0x6c9: 'и',
+	0x6ca: 'й', 0x6cb: 'к', 0x6cc: 'л', 0x6cd: 'м', 0x6ce: 'н', 0x6cf: 'о',
+	0x6d0: 'п', 0x6d1: 'я', 0x6d2: 'р', 0x6d3: 'с', 0x6d4: 'т', 0x6d5: 'у',
+	0x6d6: 'ж', 0x6d7: 'в', 0x6d8: 'ь', 0x6d9: 'ы', 0x6da: 'з', 0x6db: 'ш',
+	0x6dc: 'э', 0x6dd: 'щ', 0x6de: 'ч', 0x6df: 'ъ', 0x6e0: 'Ю', 0x6e1: 'А',
+	0x6e2: 'Б', 0x6e3: 'Ц', 0x6e4: 'Д', 0x6e5: 'Е', 0x6e6: 'Ф', 0x6e7: 'Г',
+	0x6e8: 'Х', 0x6e9: 'И', 0x6ea: 'Й', 0x6eb: 'К', 0x6ec: 'Л', 0x6ed: 'М',
+	0x6ee: 'Н', 0x6ef: 'О', 0x6f0: 'П', 0x6f1: 'Я', 0x6f2: 'Р', 0x6f3: 'С',
+	0x6f4: 'Т', 0x6f5: 'У', 0x6f6: 'Ж', 0x6f7: 'В', 0x6f8: 'Ь', 0x6f9: 'Ы',
+	0x6fa: 'З', 0x6fb: 'Ш', 0x6fc: 'Э', 0x6fd: 'Щ', 0x6fe: 'Ч', 0x6ff: 'Ъ',
+	// Greek
+	0x7c1: 'Α', 0x7c2: 'Β', 0x7c3: 'Γ', 0x7c4: 'Δ', 0x7c5: 'Ε', 0x7c6: 'Ζ',
+	0x7c7: 'Η', 0x7c8: 'Θ', 0x7c9: 'Ι', 0x7ca: 'Κ', 0x7cb: 'Λ', 0x7cc: 'Μ',
+	0x7cd: 'Ν', 0x7ce: 'Ξ', 0x7cf: 'Ο', 0x7d0: 'Π', 0x7d1: 'Ρ', 0x7d2: 'Σ',
+	0x7d4: 'Τ', 0x7d5: 'Υ', 0x7d6: 'Φ', 0x7d7: 'Χ', 0x7d8: 'Ψ', 0x7d9: 'Ω',
+	0x7e1: 'α', 0x7e2: 'β', 0x7e3: 'γ', 0x7e4: 'δ', 0x7e5: 'ε', 0x7e6: 'ζ',
+	0x7e7: 'η', 0x7e8: 'θ', 0x7e9: 'ι', 0x7ea: 'κ', 0x7eb: 'λ', 0x7ec: 'μ',
+	0x7ed: 'ν', 0x7ee: 'ξ', 0x7ef: 'ο', 0x7f0: 'π', 0x7f1: 'ρ', 0x7f2: 'σ',
+	0x7f3: 'ς', 0x7f4: 'τ', 0x7f5: 'υ', 0x7f6: 'φ', 0x7f7: 'χ', 0x7f8: 'ψ',
+	0x7f9: 'ω',
+	// Latin-9, currency and typographic punctuation
+	0x13bc: 'Œ', 0x13bd: 'œ', 0x13be: 'Ÿ', 0x20ac: '€', 0xaa9: '—', 0xaaa: '–',
+	0xaae: '…', 0xad0: '‘', 0xad1: '’', 0xad2: '“', 0xad3: '”',
+}
+
+func keysymToRune(keysym xproto.Keysym) rune {
+	// Common punctuation marks
+	punctuation := map[xproto.Keysym]rune{
+		0x003f: '?',  // Question mark
+		0x002e: '.',  // Period
+		0x002c: ',',  // Comma
+		0x0021: '!',  // Exclamation mark
+		0x0027: '\'', // Single quote
+		0x0022: '"',  // Double quote
+		0x0028: '(',  // Left parenthesis
+		0x0029: ')',  // Right parenthesis
+		0x002d: '-',  // Hyphen
+		0x005f: '_',  // Underscore
+	}
+
+	// Check punctuation map first
+	if r, ok := punctuation[keysym]; ok {
+		return r
+	}
+
+	// Basic ASCII conversion
+	if keysym < 0x100 {
+		return rune(keysym)
+	}
+
+	// Legacy keysyms still used by many national layouts
+	if r, ok := legacyKeysyms[keysym]; ok {
+		return r
+	}
+
+	// Unicode direct mapping
+	if keysym >= 0x1000000 {
+		return rune(keysym - 0x1000000)
+	}
+
+	// Common Latin-1 characters
+	if keysym >= 0x20 && keysym <= 0x7e {
+		return rune(keysym)
+	}
+
+	return 0
+}
+
+func (k *KeyboardSimulator) TypeText(text string) {
+	// CapsLock would invert the case chosen by the shift logic below, so turn
+	// it off while typing and restore it afterwards.
+	if k.capsLockActive() {
+		k.toggleCapsLock()
+		defer k.toggleCapsLock()
+	}
+	k.typeChars(text)
+}
+
+// typeChars presses each character's key, holding Shift across each run of
+// consecutive shifted characters instead of around every one of them.
+func (k *KeyboardSimulator) typeChars(text string) {
+	shift := k.modifierKeycode("shift")
+	shiftHeld := false
+	for _, char := range text {
+		stroke, err := k.strokeFor(char)
+		if err != nil {
+			log.Printf("Skipping unknown character: %c (%v)", char, err)
+			continue
+		}
+		keycode, needsShift := stroke.keycode, stroke.shift
+
+		if needsShift && !shiftHeld {
+			k.keys.keyPress(shift)
+		} else if !needsShift && shiftHeld {
+			k.keys.keyRelease(shift)
+		}
+		shiftHeld = needsShift
+
+		// Press and release the key
+		k.keys.keyPress(keycode)
+		time.Sleep(currentSettings().keyDelay)
+		k.keys.keyRelease(keycode)
+		time.Sleep(currentSettings().gap())
+	}
+
+	if shiftHeld {
+		k.keys.keyRelease(shift)
+	}
+}
+
+// readBackDelay is how long ReadBack waits after selecting for the focused
+// application to catch up and take the primary selection.
+const readBackDelay = 100 * time.Millisecond
+
+// ReadBack returns the n characters before the cursor in the focused field
+// by selecting them with Shift+Left, reading the primary selection and
+// pressing Right to deselect. A marker put in the primary selection first
+// shows whether the field took the selection. Fields that don't select with
+// Shift+Left, such as terminals, can't be read back; the cursor is moved
+// back in case it moved, but -verify-typing is best turned off for them
+// with a profile. Reading back replaces the primary selection.
+func (k *KeyboardSimulator) ReadBack(n int) (string, error) {
+	marker := fmt.Sprintf("whispertype-%d", time.Now().UnixNano())
+	if err := setSelection("primary", marker); err != nil {
+		return "", fmt.Errorf("clearing primary selection: %w", err)
+	}
+	for range n {
+		if err := k.PressKey("shift+Left"); err != nil {
+			return "", err
+		}
+	}
+	time.Sleep(readBackDelay)
+
+	selected, err := exec.Command("xclip", "-selection", "primary", "-o").Output()
+	if err != nil {
+		return "", fmt.Errorf("reading primary selection: %w", err)
+	}
+	if string(selected) == marker {
+		for range n {
+			if err := k.PressKey("Right"); err != nil {
+				return "", err
+			}
+		}
+		return "", fmt.Errorf("the focused field didn't select the typed text")
+	}
+	if err := k.PressKey("Right"); err != nil {
+		return "", err
+	}
+	return string(selected), nil
+}
+
+// FocusedClass returns the WM_CLASS instance and class names of the window
+// with input focus.
+func (k *KeyboardSimulator) FocusedClass() (string, string, error) {
+	_, wmClass, err := k.focusedClient()
+	if err != nil {
+		return "", "", err
+	}
+	// WM_CLASS holds two NUL-terminated strings: instance, then class
+	names := strings.SplitN(strings.TrimRight(string(wmClass), "\x00"), "\x00", 2)
+	if len(names) < 2 {
+		names = append(names, "")
+	}
+	return names[0], names[1], nil
+}
+
+// FocusedTitle returns the title of the window with input focus, from
+// _NET_WM_NAME or, for windows without it, WM_NAME.
+func (k *KeyboardSimulator) FocusedTitle() (string, error) {
+	window, _, err := k.focusedClient()
+	if err != nil {
+		return "", err
+	}
+	netWmName, err := xproto.InternAtom(k.conn, true, uint16(len("_NET_WM_NAME")), "_NET_WM_NAME").Reply()
+	if err != nil {
+		return "", fmt.Errorf("looking up _NET_WM_NAME: %w", err)
+	}
+	for _, atom := range []xproto.Atom{netWmName.Atom, xproto.AtomWmName} {
+		if atom == xproto.AtomNone {
+			continue
+		}
+		prop, err := xproto.GetProperty(k.conn, false, window, atom,
+			xproto.GetPropertyTypeAny, 0, 256).Reply()
+		if err != nil {
+			return "", fmt.Errorf("reading window title: %w", err)
+		}
+		if prop.ValueLen > 0 {
+			return string(prop.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// focusedClient returns the client window with input focus and its WM_CLASS
+// property. The focus is often on a child of the client window, so it walks
+// up the tree to the first window that has the property.
+func (k *KeyboardSimulator) focusedClient() (xproto.Window, []byte, error) {
+	focus, err := xproto.GetInputFocus(k.conn).Reply()
+	if err != nil {
+		return 0, nil, fmt.Errorf("getting input focus: %w", err)
+	}
+
+	window := focus.Focus
+	for window != xproto.WindowNone && window != xproto.InputFocusPointerRoot {
+		prop, err := xproto.GetProperty(k.conn, false, window, xproto.AtomWmClass,
+			xproto.AtomString, 0, 256).Reply()
+		if err != nil {
+			return 0, nil, fmt.Errorf("reading WM_CLASS: %w", err)
+		}
+		if prop.ValueLen > 0 {
+			return window, prop.Value, nil
+		}
+
+		tree, err := xproto.QueryTree(k.conn, window).Reply()
+		if err != nil {
+			return 0, nil, fmt.Errorf("querying window tree: %w", err)
+		}
+		if tree.Parent == tree.Root {
+			break
+		}
+		window = tree.Parent
+	}
+	return 0, nil, fmt.Errorf("focused window has no WM_CLASS")
+}
+
+// capsLockActive reports whether CapsLock is currently on.
+func (k *KeyboardSimulator) capsLockActive() bool {
+	root := xproto.Setup(k.conn).DefaultScreen(k.conn).Root
+	pointer, err := xproto.QueryPointer(k.conn, root).Reply()
+	if err != nil {
+		log.Printf("Failed to query lock state: %v", err)
+		return false
+	}
+	return pointer.Mask&xproto.KeyButMaskLock != 0
+}
+
+// toggleCapsLock presses and releases the CapsLock key.
+func (k *KeyboardSimulator) toggleCapsLock() {
+	keycode, ok := k.keycodeForKeysym(0xffe5) // Caps_Lock
+	if !ok {
+		log.Printf("Cannot toggle CapsLock: no keycode found")
+		return
+	}
+	k.keys.keyPress(keycode)
+	time.Sleep(currentSettings().keyDelay)
+	k.keys.keyRelease(keycode)
+	time.Sleep(currentSettings().gap())
+}
+
+// PressKey sends a key combination such as "ctrl+BackSpace" through XTEST.
+func (k *KeyboardSimulator) PressKey(spec string) error {
+	modifiers, key, err := parseKeySpec(spec)
+	if err != nil {
+		return err
+	}
+	keycode, ok := k.keycodeForKeysym(namedKeys[key].keysym)
+	if !ok {
+		return fmt.Errorf("no keycode for key %q", key)
+	}
+
+	for _, modifier := range modifiers {
+		k.keys.keyPress(k.modifierKeycode(modifier))
+	}
+	k.keys.keyPress(keycode)
+	time.Sleep(currentSettings().keyDelay)
+	k.keys.keyRelease(keycode)
+	time.Sleep(currentSettings().gap())
+	for i := len(modifiers) - 1; i >= 0; i-- {
+		k.keys.keyRelease(k.modifierKeycode(modifiers[i]))
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// recordingSender records key events as "+code" for a press and "-code" for
+// a release.
+type recordingSender struct {
+	events []string
+}
+
+func (r *recordingSender) keyPress(keycode byte) {
+	r.events = append(r.events, fmt.Sprintf("+%d", keycode))
+}
+
+func (r *recordingSender) keyRelease(keycode byte) {
+	r.events = append(r.events, fmt.Sprintf("-%d", keycode))
+}
+
+// usKeycodes lists the keysyms of a few keys on a US layout, as unshifted
+// and shifted levels.
+var usKeycodes = map[byte][2]xproto.Keysym{
+	10: {'1', '!'},
+	26: {'e', 'E'},
+	31: {'i', 'I'},
+	32: {'o', 'O'},
+	43: {'h', 'H'},
+	46: {'l', 'L'},
+	50: {0xffe1}, // Shift_L
+	65: {' '},
+}
+
+// testKeyboard returns a KeyboardSimulator typing on usKeycodes into a
+// recordingSender.
+func testKeyboard() (*KeyboardSimulator, *recordingSender) {
+	sender := &recordingSender{}
+	keyboard := &KeyboardSimulator{keys: sender}
+	keyboard.setKeymap(testMinKeycode, 2, testMapping(usKeycodes))
+	return keyboard, sender
+}
+
+// testMinKeycode and testMaxKeycode are the keycodes testMapping covers.
+const testMinKeycode, testMaxKeycode = 8, 65
+
+// testMapping returns a keyboard mapping with two levels per keycode from
+// testMinKeycode to testMaxKeycode, binding the keycodes in levels.
+func testMapping(levels map[byte][2]xproto.Keysym) []xproto.Keysym {
+	keysyms := make([]xproto.Keysym, 0, 2*(testMaxKeycode-testMinKeycode+1))
+	for keycode := testMinKeycode; keycode <= testMaxKeycode; keycode++ {
+		key := levels[byte(keycode)]
+		keysyms = append(keysyms, key[:]...)
+	}
+	return keysyms
+}
+
+func TestTypeChars(t *testing.T) {
+	keyboard, sender := testKeyboard()
+	keyboard.typeChars("Hi! ")
+	want := []string{
+		"+50", "+43", "-43", // H
+		"-50", "+31", "-31", // i
+		"+50", "+10", "-10", // !
+		"-50", "+65", "-65", // trailing space
+	}
+	if !slices.Equal(sender.events, want) {
+		t.Errorf("typeChars(%q) sent %v, want %v", "Hi! ", sender.events, want)
+	}
+}
+
+// TestTypeCharsShiftRuns checks that Shift is held across each run of
+// shifted characters and only pressed and released at its ends.
+func TestTypeCharsShiftRuns(t *testing.T) {
+	// Each keycode stands for its press and release
+	const shift, unshift = -1, -2
+	for _, test := range []struct {
+		text    string
+		strokes []int
+	}{
+		{"hello", []int{43, 26, 46, 46, 32}},
+		{"HELLO", []int{shift, 43, 26, 46, 46, 32, unshift}},
+		{"HEllo", []int{shift, 43, 26, unshift, 46, 46, 32}},
+		{"heLLo", []int{43, 26, shift, 46, 46, unshift, 32}},
+		{"hELLO!", []int{43, shift, 26, 46, 46, 32, 10, unshift}},
+		{"Oh hi", []int{shift, 32, unshift, 43, 65, 43, 31}},
+	} {
+		var want []string
+		for _, stroke := range test.strokes {
+			switch stroke {
+			case shift:
+				want = append(want, "+50")
+			case unshift:
+				want = append(want, "-50")
+			default:
+				want = append(want, fmt.Sprintf("+%d", stroke), fmt.Sprintf("-%d", stroke))
+			}
+		}
+		keyboard, sender := testKeyboard()
+		keyboard.typeChars(test.text)
+		if !slices.Equal(sender.events, want) {
+			t.Errorf("typeChars(%q) sent %v, want %v", test.text, sender.events, want)
+		}
+	}
+}
+
+func TestBuildKeymap(t *testing.T) {
+	// Four levels per keycode: plain, Shift, AltGr and AltGr+Shift
+	levels := map[byte][4]xproto.Keysym{
+		10: {'1', '!', 0xb9},                   // ¹ only with AltGr
+		26: {'e', 'E', 0x20ac},                 // EuroSign with AltGr
+		34: {0xfc, 0xdc},                       // udiaeresis, Udiaeresis
+		35: {0x1b3, 0x1a3},                     // Latin-2 lstroke, Lstroke
+		36: {0x6c1, 0x6e1},                     // Cyrillic_a, Cyrillic_A
+		37: {0x1000000 + 'ə', 0x1000000 + 'Ə'}, // Unicode keysyms
+		38: {'a'},                              // Letter with an implied uppercase
+		50: {0xffe1},                           // Shift_L
+		65: {' '},
+	}
+	const minKeycode, maxKeycode = 8, 70
+	var keysyms []xproto.Keysym
+	for keycode := minKeycode; keycode <= maxKeycode; keycode++ {
+		key := levels[byte(keycode)]
+		keysyms = append(keysyms, key[:]...)
+	}
+
+	keymap, firstCodes, spare := buildKeymap(minKeycode, 4, keysyms)
+	for char, want := range map[rune]keyStroke{
+		'1': {10, false}, '!': {10, true},
+		'e': {26, false}, 'E': {26, true},
+		'ü': {34, false}, 'Ü': {34, true},
+		'ł': {35, false}, 'Ł': {35, true},
+		'а': {36, false}, 'А': {36, true},
+		'ə': {37, false}, 'Ə': {37, true},
+		'a': {38, false}, 'A': {38, true},
+		' ': {65, false},
+	} {
+		if got, ok := keymap[char]; !ok || got != want {
+			t.Errorf("keymap[%q] = %+v, %v; want %+v", char, got, ok, want)
+		}
+	}
+	// AltGr characters are typed by remapping a spare keycode
+	for _, char := range []rune{'¹', '€'} {
+		if stroke, ok := keymap[char]; ok {
+			t.Errorf("keymap[%q] = %+v, want it left out", char, stroke)
+		}
+	}
+	if got := firstCodes[0xffe1]; got != 50 {
+		t.Errorf("keycode for Shift_L = %d, want 50", got)
+	}
+	if got := firstCodes[0x20ac]; got != 26 {
+		t.Errorf("keycode for EuroSign = %d, want 26", got)
+	}
+	if !slices.Contains(spare, 40) || slices.Contains(spare, 26) {
+		t.Errorf("spare keycodes = %v, want 40 and not 26", spare)
+	}
+}
+
+func TestKeysymRoundTrip(t *testing.T) {
+	for _, char := range "aZ9 !?é×ÿłŁ€ə→😀" {
+		if got := keysymToRune(runeToKeysym(char)); got != char {
+			t.Errorf("keysymToRune(runeToKeysym(%q)) = %q", char, got)
+		}
+	}
+}
+
+// TestKeymapRebuild checks that a layout change, such as setxkbmap
+// switching from US to German, replaces the keymap and forgets remapped
+// keycodes, while the notifications remap causes itself are ignored.
+func TestKeymapRebuild(t *testing.T) {
+	us := map[byte][2]xproto.Keysym{29: {'y', 'Y'}, 52: {'z', 'Z'}, 50: {0xffe1}}
+	de := map[byte][2]xproto.Keysym{29: {'z', 'Z'}, 52: {'y', 'Y'}, 50: {0xffe1}, 20: {0xdf, '?'}}
+	keyboard := &KeyboardSimulator{keys: &recordingSender{}}
+	keyboard.setKeymap(testMinKeycode, 2, testMapping(us))
+	keyboard.remapped['ß'] = keyboard.spareKeycodes[0]
+
+	// A keyboard simulator without an X connection would panic if these
+	// tried to fetch the mapping
+	keyboard.handleMappingNotify(xproto.MappingNotifyEvent{Request: xproto.MappingPointer})
+	keyboard.handleMappingNotify(xproto.MappingNotifyEvent{
+		Request: xproto.MappingKeyboard, FirstKeycode: xproto.Keycode(keyboard.spareKeycodes[0]), Count: 1,
+	})
+	if stroke, _ := keyboard.strokeFor('ß'); stroke.keycode != keyboard.spareKeycodes[0] {
+		t.Errorf("strokeFor('ß') before the layout change = %+v, want the remapped keycode", stroke)
+	}
+
+	keyboard.setKeymap(testMinKeycode, 2, testMapping(de))
+	for char, want := range map[rune]keyStroke{'z': {29, false}, 'Y': {52, true}, 'ß': {20, false}, '?': {20, true}} {
+		if got, err := keyboard.strokeFor(char); err != nil || got != want {
+			t.Errorf("strokeFor(%q) after the layout change = %+v, %v; want %+v", char, got, err, want)
+		}
+	}
+	if len(keyboard.remapped) != 0 {
+		t.Errorf("remapped keycodes after the layout change = %v, want none", keyboard.remapped)
+	}
+	if got, ok := keyboard.keycodeForKeysym(0xffe1); !ok || got != 50 {
+		t.Errorf("keycodeForKeysym(Shift_L) = %d, %v; want 50", got, ok)
+	}
+}
+
+// TestTypeCharsLayouts checks that whether a character needs Shift comes
+// from the layout rather than from US QWERTY.
+func TestTypeCharsLayouts(t *testing.T) {
+	azerty := map[byte][2]xproto.Keysym{
+		10: {'&', '1'},
+		11: {0xe9, '2'}, // eacute
+		24: {'a', 'A'},
+		58: {',', '?'},
+		61: {'!', 0xa7}, // section
+		50: {0xffe1},
+	}
+	dvorak := map[byte][2]xproto.Keysym{
+		24: {'\'', '"'},
+		25: {',', '<'},
+		38: {'a', 'A'},
+		52: {';', ':'},
+		50: {0xffe1},
+	}
+	for _, test := range []struct {
+		name   string
+		layout map[byte][2]xproto.Keysym
+		text   string
+		want   []string
+	}{
+		{"AZERTY digits", azerty, "12", []string{"+50", "+10", "-10", "+11", "-11", "-50"}},
+		{"AZERTY symbols", azerty, "&é!", []string{"+10", "-10", "+11", "-11", "+61", "-61"}},
+		{"AZERTY mixed", azerty, "A1!?", []string{"+50", "+24", "-24", "+10", "-10", "-50", "+61", "-61", "+50", "+58", "-58", "-50"}},
+		{"Dvorak", dvorak, "a:\"'", []string{"+38", "-38", "+50", "+52", "-52", "+24", "-24", "-50", "+24", "-24"}},
+	} {
+		sender := &recordingSender{}
+		keyboard := &KeyboardSimulator{keys: sender}
+		keyboard.setKeymap(testMinKeycode, 2, testMapping(test.layout))
+		keyboard.typeChars(test.text)
+		if !slices.Equal(sender.events, test.want) {
+			t.Errorf("%s: typeChars(%q) sent %v, want %v", test.name, test.text, sender.events, test.want)
+		}
+	}
+}
+
+// TestTypeCharsShiftKeycode checks that Shift is pressed with the keycode
+// the layout binds Shift_L to, or the usual one when it has none.
+func TestTypeCharsShiftKeycode(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		shift byte // Keycode bound to Shift_L, 0 for none
+		want  string
+	}{
+		{"usual keycode", 50, "+50"},
+		{"moved", 62, "+62"},
+		{"missing", 0, "+50"},
+	} {
+		layout := map[byte][2]xproto.Keysym{38: {'a', 'A'}}
+		if test.shift != 0 {
+			layout[test.shift] = [2]xproto.Keysym{0xffe1}
+		}
+		sender := &recordingSender{}
+		keyboard := &KeyboardSimulator{keys: sender}
+		keyboard.setKeymap(testMinKeycode, 2, testMapping(layout))
+		keyboard.typeChars("A")
+		if len(sender.events) == 0 || sender.events[0] != test.want {
+			t.Errorf("%s: typeChars(%q) sent %v, want Shift pressed with %s", test.name, "A", sender.events, test.want)
+		}
+	}
+}
+
+// TestPressKeyModifiers checks that modifiers are pressed with the keycodes
+// the layout binds them to.
+func TestPressKeyModifiers(t *testing.T) {
+	layout := map[byte][2]xproto.Keysym{
+		22: {0xff08}, // BackSpace
+		40: {0xffe3}, // Control_L, usually 37
+		50: {0xffe1}, // Shift_L
+		64: {0xffe9}, // Alt_L
+	}
+	sender := &recordingSender{}
+	keyboard := &KeyboardSimulator{keys: sender}
+	keyboard.setKeymap(testMinKeycode, 2, testMapping(layout))
+	if err := keyboard.PressKey("ctrl+shift+BackSpace"); err != nil {
+		t.Fatalf("PressKey error = %v", err)
+	}
+	want := []string{"+40", "+50", "+22", "-22", "-50", "-40"}
+	if !slices.Equal(sender.events, want) {
+		t.Errorf("PressKey(%q) sent %v, want %v", "ctrl+shift+BackSpace", sender.events, want)
+	}
+}
@@ -1,38 +1,165 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "embed"
 
 	"flag"
 
-	"github.com/BurntSushi/xgb"
-	"github.com/BurntSushi/xgb/xproto"
-	"github.com/BurntSushi/xgb/xtest"
 	"github.com/getlantern/systray"
 )
 
 // Audio configuration constants
 const (
-	sampleRate      = 16000
-	channels        = 1
-	recordTimeout   = 1 * time.Second        // Reduced from 2s to 1s for faster chunks
-	silenceDuration = 300 * time.Millisecond // Reduced from 500ms to 300ms for quicker detection
-	energyThreshold = 80                     // Energy threshold for silence detection
+	sampleRate      = 16000                   // Default capture sample rate
+	channels        = 1                       // Default capture channel count
+	recordTimeout   = 1 * time.Second         // Default chunk duration, reduced from 2s to 1s for faster chunks
+	silenceDuration = 300 * time.Millisecond  // Reduced from 500ms to 300ms for quicker detection
+	sentenceSilence = 1200 * time.Millisecond // Silence that ends a sentence
+	energyThreshold = 80                      // Energy threshold for silence detection
+	noiseFloorRatio = 1.5                     // Adaptive threshold as a multiple of the noise floor
+	noiseFloorAlpha = 0.1                     // Weight of each silent chunk in the noise floor average
+	zcrThreshold    = 0.1                     // Zero-crossing rate above which a chunk counts as speech
 )
 
+// Auto gain parameters for -auto-gain
+const (
+	autoGainTargetRMS = 3000.0 // RMS that phrases are normalized to
+	autoGainMax       = 20.0   // Largest gain applied, so near-silence isn't blown up
+)
+
+// Tray level meter parameters
+const (
+	levelInterval = 250 * time.Millisecond // Minimum time between tooltip updates
+	levelAlpha    = 0.5                    // Weight of each chunk in the smoothed level
+	levelFloorDB  = -60.0                  // Level, in dBFS, shown as an empty meter
+	levelWidth    = 10                     // Characters in the meter bar
+)
+
+// Transcription request timeouts: requestBaseTimeout plus
+// requestTimeoutPerSecond for every second of audio sent.
+const (
+	requestBaseTimeout      = 30 * time.Second
+	requestTimeoutPerSecond = 2 * time.Second
+)
+
+// shutdownTimeout bounds how long a signal-triggered shutdown waits for the
+// final phrase to be transcribed.
+const shutdownTimeout = 5 * time.Second
+
+// maxCaptureRestarts is how many times in a row run restarts a capture
+// process that died before giving up on the session.
+const maxCaptureRestarts = 3
+
+// minKeyDelay is the floor for -key-delay and -key-gap. Shorter delays make
+// some applications, and most remote desktops, drop or reorder keystrokes.
+const minKeyDelay = time.Millisecond
+
+// maxTypingSlowdown caps the extra pause -verify-typing adds after each
+// keystroke once it has seen keystrokes dropped.
+const maxTypingSlowdown = 50 * time.Millisecond
+
+// minLanguageConfidence is the detection probability below which a detected
+// language doesn't count towards -language-lock.
+const minLanguageConfidence = 0.5
+
+// Bounds for the chunk, silence detection and phrase flags, enforced by
+// validateFlags. Shorter pauses end phrases mid-word, and a phrase limit
+// below two chunks forces a transcription on nearly every chunk.
+const (
+	minChunk     = 20 * time.Millisecond // Shorter chunks are too few samples to classify
+	maxChunk     = 10 * time.Second
+	minPause     = 100 * time.Millisecond
+	maxThreshold = math.MaxInt16 // Higher thresholds make every chunk silent
+)
+
+// hotkeyDebounce is the default for -hotkey-debounce.
+const hotkeyDebounce = 200 * time.Millisecond
+
+// autoRepeatDebounce is how long push-to-talk waits after a hotkey release for
+// an auto-repeat press before treating the release as real.
+const autoRepeatDebounce = 50 * time.Millisecond
+
+// AudioConfig describes the raw PCM format captured by recordLoop and sent
+// for transcription. It is set once from flags in main.
+type AudioConfig struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// validate checks that the format is usable and that its byte rate fits the
+// uint32 WAV header field and the chunk-size math in recordLoop.
+func (c AudioConfig) validate() error {
+	if c.SampleRate <= 0 || c.SampleRate > 384000 {
+		return fmt.Errorf("sample rate %d out of range", c.SampleRate)
+	}
+	if c.Channels <= 0 || c.Channels > 8 {
+		return fmt.Errorf("channel count %d out of range", c.Channels)
+	}
+	if c.BitsPerSample != 16 {
+		return fmt.Errorf("unsupported bits per sample %d", c.BitsPerSample)
+	}
+	if int64(c.SampleRate)*int64(c.Channels)*int64(c.BitsPerSample/8) > math.MaxInt32 {
+		return fmt.Errorf("byte rate for %d Hz x %d channels overflows", c.SampleRate, c.Channels)
+	}
+	return nil
+}
+
+// bytesPerSecond returns the size of one second of audio.
+func (c AudioConfig) bytesPerSecond() int {
+	return c.SampleRate * c.Channels * (c.BitsPerSample / 8)
+}
+
+// chunkBytes returns the size of a chunk lasting d, rounded down to whole
+// sample frames.
+func (c AudioConfig) chunkBytes(d time.Duration) int {
+	frameBytes := c.Channels * (c.BitsPerSample / 8)
+	return int(d.Seconds()*float64(c.bytesPerSecond())) / frameBytes * frameBytes
+}
+
+// samplesIn returns the number of interleaved samples covering d, in whole
+// frames so that channels stay aligned.
+func (c AudioConfig) samplesIn(d time.Duration) int {
+	return int(d.Seconds()*float64(c.SampleRate)) * c.Channels
+}
+
+// durationOf returns how long the given number of interleaved samples plays.
+func (c AudioConfig) durationOf(samples int) time.Duration {
+	return time.Duration(samples) * time.Second / time.Duration(c.SampleRate*c.Channels)
+}
+
 // AudioChunk represents a block of recorded samples along with the time it was captured.
 type AudioChunk struct {
 	timestamp time.Time
@@ -41,14 +168,33 @@ type AudioChunk struct {
 
 // Create reusable buffers at package level
 var (
-	wavBuffer  bytes.Buffer
-	httpClient = &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	// wavBuffers holds buffers for encoding WAV uploads, which may be
+	// built concurrently with -max-requests above 1.
+	wavBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	// httpClient has no overall timeout; each request gets one scaled to
+	// its audio length (see requestTimeout).
+	httpClient = &http.Client{}
 	//go:embed icon_off.png
 	iconOff []byte
 	//go:embed icon_on.png
 	iconOn []byte
+	//go:embed sound_start.wav
+	soundStart []byte
+	//go:embed sound_stop.wav
+	soundStop []byte
+	//go:embed webui.html
+	webUI []byte
+	// transcriptLog records transcribed phrases when -log-file is set.
+	transcriptLog *TranscriptLog
+	// energyLog records each chunk's energy when -energy-dump is set.
+	energyLog *EnergyDump
+	// stats accumulates capture and transcription counters for -stats.
+	stats Stats
+	// audioConfig is the capture format, set from -rate and -channels.
+	audioConfig AudioConfig
+	// encoder is the command that converts uploads to the -encode format, or
+	// nil to upload WAV as-is.
+	encoder []string
 )
 
 // AudioChunkParams defines the parameters for chunking audio
@@ -58,490 +204,4758 @@ const (
 	chunkOverlap     = 500 * time.Millisecond // Overlap between chunks to avoid cutting words
 )
 
+// chunkedThreshold is the phrase length above which run transcribes in
+// overlapping chunks rather than one request. Whisper itself works in 30
+// second windows.
+const chunkedThreshold = 30 * time.Second
+
 // Configuration constants
 var (
 	serverHost = flag.String("host", "localhost", "Whisper server host")
 	serverPort = flag.Int("port", 36124, "Whisper server port")
+	serverURL  = flag.String("url", "", "Full transcription endpoint URL; overrides -host and -port when set")
+	serverList = flag.String("servers", "", "Comma-separated transcription endpoints, as URLs or host:port, tried in order when one is unreachable; overrides -url, -host and -port")
+	apiKind    = flag.String("api", "whispercpp", "Transcription API: whispercpp or openai")
+	apiToken   = flag.String("token", os.Getenv("WHISPER_API_KEY"), "Bearer token for the openai API (defaults to $WHISPER_API_KEY)")
+	serverType = flag.String("server-type", "auto", "Response format to expect: auto, whisper (text field) or faster-whisper (segments)")
+	apiModel   = flag.String("model", "whisper-1", "Model form field sent in openai mode")
+	fileField  = flag.String("file-field", "file", "Multipart form field the audio is uploaded in")
+	fmtField   = flag.String("format-field", "response_format", "Multipart form field naming the response format")
+	prompt     = flag.String("prompt", "", "Text sent as the prompt field to bias transcription toward names and jargon")
+	promptFile = flag.String("prompt-file", "", "File of vocabulary, one term per line, added to the prompt")
+	language   = flag.String("language", "", "ISO-639-1 language code to transcribe in (auto-detect when empty)")
+	langLock   = flag.Int("language-lock", 3, "Consistent detections after which an auto-detected language is used for the rest of the recording session (0 disables)")
+	streamURL  = flag.String("stream-url", "", "Websocket endpoint (ws:// or wss://) for streaming transcription; replaces the HTTP API when set")
+	maxRetries = flag.Int("retries", 3, "Maximum transcription request attempts on transient failures")
+	pause      = flag.Duration("pause", silenceDuration, "Silence that ends a phrase; shorter breath pauses stay within the phrase")
+	sentPause  = flag.Duration("sentence-pause", sentenceSilence, "Silence that ends a sentence, adding -sentence-end if the phrase lacks one")
+	sentEnd    = flag.String("sentence-end", ".", "Punctuation typed after a phrase at a -sentence-pause unless it already ends a sentence (disabled when empty)")
+	phraseCtx  = flag.Bool("phrase-context", false, "Prepend the last 500ms of the previous phrase to the next one for context, dropping the repeated words; slightly slower")
+	dedupWords = flag.Int("overlap-words", 8, "Most trailing words compared when dropping text repeated at chunk and phrase seams; raise for fast speakers")
+	chunked    = flag.Bool("chunked", false, "Always transcribe phrases in overlapping chunks, not only phrases longer than 30s")
+	streaming  = flag.Bool("streaming", false, "Type interim transcriptions while speaking and correct them as the phrase completes")
+	realtime   = flag.Bool("realtime", false, "Transcribe and type each chunk of speech as it arrives instead of waiting for a pause; faster but less accurate")
+	streamStep = flag.Int("stream-every", 2, "Chunks of speech between interim transcriptions in streaming mode")
+	maxReqs    = flag.Int("max-requests", 1, "Transcription requests in flight at once; raise for a server that handles several in parallel")
+	minSpeech  = flag.Int("min-speech-chunks", 2, "Consecutive non-silent chunks needed to start a phrase, so isolated clicks aren't transcribed (1 disables)")
+	idleLimit  = flag.Duration("idle-timeout", 0, "Stop recording after this much continuous silence (disabled when 0)")
+	maxPhrase  = flag.Duration("max-phrase", 15*time.Second, "Longest phrase buffered before forcing transcription without a pause")
+	threshold  = flag.String("threshold", strconv.Itoa(energyThreshold), "Silence energy threshold, or auto to adapt to the noise floor")
+	zcrLimit   = flag.Float64("zcr-threshold", zcrThreshold, "Zero-crossing rate (crossings per sample) above which a chunk counts as speech")
+	undoSpec   = flag.String("undo-hotkey", "", "Hotkey that deletes the last typed phrase, e.g. super+shift+z (disabled when empty)")
+	safeStart  = flag.Bool("safe", false, "Start in safe mode, which drops all typing until -safe-hotkey turns it off")
+	safeSpec   = flag.String("safe-hotkey", "", "Hotkey that toggles safe mode, halting all typing immediately, e.g. super+shift+x (disabled when empty)")
+	manualEnd  = flag.Bool("manual-flush", false, "Only end a phrase on -flush-hotkey or the /flush API, never at a pause; silence is kept in the phrase")
+	flushSpec  = flag.String("flush-hotkey", "", "Hotkey that ends the phrase being recorded with -manual-flush, e.g. super+shift+d (disabled when empty)")
+	debounce   = flag.Duration("hotkey-debounce", hotkeyDebounce, "Ignore hotkey presses this soon after the previous press of the same hotkey, from key bounce or auto-repeat (disabled when 0)")
+	pauseSpec  = flag.String("pause-hotkey", "", "Hotkey that pauses and resumes recording without ending the phrase, e.g. super+shift+p (disabled when empty)")
+	hotkeySpec = flag.String("hotkey", "super+shift+a", "Hotkey that toggles recording (e.g. ctrl+alt+space)")
+	apiPort    = flag.Int("api-port", 0, "Port for the local status/control HTTP API and web UI, served on 127.0.0.1 only (disabled when 0)")
+	mode       = flag.String("mode", "toggle", "Hotkey mode: toggle (press to start/stop) or ptt (record while held)")
+	capture    = flag.String("capture", "auto", "Audio capture backend: auto or one of "+strings.Join(captureBackends, ", "))
+	highPass   = flag.Float64("high-pass", 0, "Cutoff in Hz of a high-pass filter applied before silence detection, e.g. 80 for rumble (disabled when 0)")
+	filterAud  = flag.Bool("filter-audio", false, "Also send the DC-corrected, high-passed audio for transcription instead of the raw capture")
+	chunkLen   = flag.Duration("chunk", recordTimeout, "Duration of each captured audio chunk; shorter chunks react faster but classify silence less reliably")
+	rate       = flag.Int("rate", sampleRate, "Capture sample rate in Hz")
+	numChans   = flag.Int("channels", channels, "Capture channel count")
+	inputFile  = flag.String("file", "", "Transcribe this WAV file, print the result, and exit")
+	once       = flag.Bool("once", false, "Record a single phrase, type it and exit, without the tray or hotkey, for launching from another hotkey daemon")
+	readStdin  = flag.Bool("stdin", false, "Read 16-bit little-endian PCM at -rate and -channels from stdin instead of capturing, print the phrases, and exit at end of input")
+	device     = flag.String("device", "", "Audio source to record from (default source when empty)")
+	listDevs   = flag.Bool("list-devices", false, "List available audio sources and exit")
+	calibrate  = flag.Bool("calibrate", false, "Record a few seconds of room noise, print a recommended -threshold, and exit")
+	calSave    = flag.Bool("calibrate-save", false, "With -calibrate, also write the recommended -threshold to the config file")
+	notify     = flag.Bool("notify", true, "Show a desktop notification when transcription fails or recording stops on an error")
+	sounds     = flag.Bool("sounds", true, "Play audible cues when recording starts and stops")
+	filterFile = flag.String("filter-file", "", "File of regular expressions, one per line, that replace the default hallucination filters")
+	keyPrefix  = flag.String("shortcut-prefix", "press", "Word that starts a spoken shortcut such as \"press control c\" (disabled when empty)")
+	fixPrefix  = flag.String("correction-prefix", "correct that to", "Words that replace the last typed word with the words after them, as in \"correct that to Kyle\" (disabled when empty)")
+	commands   = flag.String("commands", "", "JSON file mapping spoken phrases to key actions, merged over the defaults")
+	profiles   = flag.String("profiles", "", "JSON file of per-application typing profiles, matched against the focused window's WM_CLASS")
+	logFile    = flag.String("log-file", "", "Append each transcribed phrase to this file with a timestamp")
+	energyCSV  = flag.String("energy-dump", "", "Append each chunk's time, energy, silence threshold and whether it counted as silent to this CSV file, for choosing -threshold")
+	gain       = flag.Float64("gain", 1, "Gain multiplier applied to audio sent for transcription")
+	autoGain   = flag.Bool("auto-gain", false, "Normalize each phrase to a target loudness before transcription (overrides -gain)")
+	logFormat  = flag.String("log-format", "text", "Log format: text, or json for one structured record per line")
+	debug      = flag.Bool("debug", false, "Log per-chunk audio levels and silence detection")
+	outputMode = flag.String("output", "type", "Output mode: type (simulate keystrokes) or paste (clipboard + Ctrl+V, with xclip or on Wayland wl-copy)")
+	noTrailing = flag.Bool("no-trailing-space", false, "Don't type a space after each phrase")
+	dryRun     = flag.Bool("dry-run", false, "Print phrases to stdout instead of typing them into the focused window")
+	showStats  = flag.Bool("stats", false, "Log chunk, transcription and latency counters when each recording session ends")
+	fmtNumbers = flag.Bool("format-numbers", false, "Type spoken English numbers such as \"three hundred and five\" as digits; single words below ten are left alone")
+	numLocale  = flag.String("number-locale", "en", "Separators for -format-numbers: en (12,345.6), de, es, it, nl, pt (12.345,6), fr, pl, ru, sv (12 345,6)")
+	phraseLine = flag.Bool("insert-newline-between-phrases", false, "Press Return after each phrase ending at a pause instead of typing a trailing space, e.g. for bullet notes")
+	standalone = flag.Bool("standalone", false, "Type each recording session as standalone text, without a trailing space after its last phrase")
+	keyDelay   = flag.Duration("key-delay", 5*time.Millisecond, "How long each simulated key is held down")
+	keyGap     = flag.Duration("key-gap", 5*time.Millisecond, "Pause after each simulated key; raise both for remote desktops that drop keystrokes")
+	verifyType = flag.Bool("verify-typing", false, "Read each typed phrase back by selecting it with Shift+Left (X11 with xclip only; not on Wayland, macOS, with -output paste or in terminals) and slow typing down when keystrokes were dropped")
+	verifyTry  = flag.Int("verify-retries", 1, "Times -verify-typing erases and retypes a phrase that came out with keystrokes missing (0 only slows typing down)")
+	healthInt  = flag.Duration("health-every", 30*time.Second, "How often to check that the transcription server is reachable, shown in the tray (disabled when 0)")
+	spoolDir   = flag.String("spool-dir", "", "Save phrases that can't be sent while the server is unreachable to this directory as WAV files, and transcribe them once it is back")
+	warmUp     = flag.Bool("warm-up", true, "Send a short silent clip to the whisper.cpp server on startup so the model is loaded before the first phrase")
+	saveSRT    = flag.String("save-srt", "", "Write an SRT subtitle file of each recording session's timed segments to this path")
+	encoding   = flag.String("encode", "wav", "Upload encoding: wav, or flac or opus to shrink uploads to remote servers (needs ffmpeg, flac or opusenc)")
+	waitServer = flag.Duration("wait-server", 0, "How long the startup warm-up keeps retrying while the server is unreachable (fail immediately when 0)")
+)
+
+// debugf logs only when -debug is set. Use it for per-chunk detail that
+// would otherwise flood the log; errors should always use log directly.
+func debugf(format string, args ...any) {
+	if *debug {
+		logEvent(slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// setupLogging applies -log-format. The json format routes the standard
+// logger through a slog JSON handler, so every log line becomes a record.
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+	case "json":
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+		slog.SetDefault(slog.New(handler))
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	return nil
+}
+
+// logEvent logs msg at level, dropping debug messages unless -debug is set.
+// Text logs show only msg; JSON records also carry fields, alternating keys
+// and values as for slog.Log, so log processors needn't parse msg.
+func logEvent(level slog.Level, msg string, fields ...any) {
+	if level < slog.LevelInfo && !*debug {
+		return
+	}
+	if *logFormat != "json" {
+		log.Print(msg)
+		return
+	}
+	slog.Log(context.Background(), level, msg, fields...)
+}
+
+// supportedLanguages lists the ISO-639-1 codes accepted by -language.
+var supportedLanguages = []string{
+	"ar", "cs", "da", "de", "el", "en", "es", "fa", "fi", "fr",
+	"he", "hi", "hu", "id", "it", "ja", "ko", "ms", "nl", "no",
+	"pl", "pt", "ro", "ru", "sk", "sv", "th", "tr", "uk", "vi", "zh",
+}
+
+// languageNames maps the English names that whisper.cpp and OpenAI report
+// for a detected language to the codes in supportedLanguages.
+var languageNames = map[string]string{
+	"arabic": "ar", "czech": "cs", "danish": "da", "german": "de", "greek": "el",
+	"english": "en", "spanish": "es", "persian": "fa", "finnish": "fi", "french": "fr",
+	"hebrew": "he", "hindi": "hi", "hungarian": "hu", "indonesian": "id", "italian": "it",
+	"japanese": "ja", "korean": "ko", "malay": "ms", "dutch": "nl", "norwegian": "no",
+	"polish": "pl", "portuguese": "pt", "romanian": "ro", "russian": "ru", "slovak": "sk",
+	"swedish": "sv", "thai": "th", "turkish": "tr", "ukrainian": "uk", "vietnamese": "vi",
+	"chinese": "zh",
+}
+
+// languageCode returns the supported language code for a detected language,
+// given as a code or an English name, or "" if it isn't supported.
+func languageCode(detected string) string {
+	detected = strings.ToLower(strings.TrimSpace(detected))
+	if code, ok := languageNames[detected]; ok {
+		return code
+	}
+	if slices.Contains(supportedLanguages, detected) {
+		return detected
+	}
+	return ""
+}
+
+// validateLanguage reports an error if code is set but not a supported language.
+func validateLanguage(code string) error {
+	if code == "" {
+		return nil
+	}
+	for _, supported := range supportedLanguages {
+		if code == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown language %q (expected one of %s)", code, strings.Join(supportedLanguages, ", "))
+}
+
+// validateFlags rejects flag values that can't work and clamps ones that
+// are merely out of range to the nearest sensible value, logging each
+// change.
+func validateFlags() error {
+	if err := validateThreshold(*threshold); err != nil {
+		return fmt.Errorf("invalid -threshold: %w", err)
+	}
+	if *zcrLimit <= 0 || *zcrLimit > 1 {
+		return fmt.Errorf("invalid -zcr-threshold %v: must be above 0 and at most 1", *zcrLimit)
+	}
+	if *gain <= 0 {
+		return fmt.Errorf("invalid -gain %v: must be positive", *gain)
+	}
+	if *chunkLen < minChunk || *chunkLen > maxChunk {
+		return fmt.Errorf("invalid -chunk %v: must be between %v and %v", *chunkLen, minChunk, maxChunk)
+	}
+	if audioConfig.chunkBytes(*chunkLen) == 0 {
+		return fmt.Errorf("invalid -chunk %v: shorter than one sample at %d Hz", *chunkLen, audioConfig.SampleRate)
+	}
+
+	clampDuration := func(name string, value *time.Duration, floor time.Duration) {
+		if *value < floor {
+			log.Printf("-%s %v is below %v, using %v", name, *value, floor, floor)
+			*value = floor
+		}
+	}
+	clampDuration("pause", pause, minPause)
+	clampDuration("sentence-pause", sentPause, *pause)
+	clampDuration("max-phrase", maxPhrase, 2**chunkLen)
+	clampDuration("idle-timeout", idleLimit, 0)
+	clampDuration("wait-server", waitServer, 0)
+	clampDuration("health-every", healthInt, 0)
+	if *spoolDir != "" && *healthInt == 0 {
+		return fmt.Errorf("-spool-dir needs -health-every to tell when the server is back")
+	}
+	if *manualEnd && *realtime {
+		return fmt.Errorf("-manual-flush can't be used with -realtime, which types each chunk as it arrives")
+	}
+	if *manualEnd && *flushSpec == "" && *apiPort == 0 && !*readStdin {
+		return fmt.Errorf("-manual-flush needs -flush-hotkey or -api-port to end phrases")
+	}
+	if *outputMode != "type" && *outputMode != "paste" {
+		return fmt.Errorf("invalid -output %q: must be type or paste", *outputMode)
+	}
+	if err := validateNumberLocale(*numLocale); err != nil {
+		return err
+	}
+	if *fileField == "" || *fmtField == "" {
+		return fmt.Errorf("-file-field and -format-field must not be empty")
+	}
+	if _, err := parseServers(*serverList); err != nil {
+		return err
+	}
+	clampDuration("key-delay", keyDelay, minKeyDelay)
+	clampDuration("hotkey-debounce", debounce, 0)
+	clampDuration("key-gap", keyGap, minKeyDelay)
+
+	clampInt := func(name string, value *int, floor int) {
+		if *value < floor {
+			log.Printf("-%s %d is below %d, using %d", name, *value, floor, floor)
+			*value = floor
+		}
+	}
+	clampInt("stream-every", streamStep, 1)
+	clampInt("max-requests", maxReqs, 1)
+	clampInt("min-speech-chunks", minSpeech, 1)
+	clampInt("overlap-words", dedupWords, 1)
+	clampInt("retries", maxRetries, 1)
+	clampInt("language-lock", langLock, 0)
+	clampInt("verify-retries", verifyTry, 0)
+	return nil
+}
+
+// hotkeyInput is the global hotkey side of an input backend.
+type hotkeyInput struct {
+	events <-chan hotkeyEvent
+	// regrab grabs the hotkeys again. It returns an error if the recording
+	// hotkey couldn't be grabbed at all, and is nil when the platform has no
+	// global hotkey.
+	regrab func() error
+}
+
+// hotkeyRegrabInterval is how often onReady grabs the hotkeys again, since
+// X gives no notice when a grab is lost or another client releases the key.
+const hotkeyRegrabInterval = 30 * time.Second
+
+// hotkeyLost is set while the recording hotkey can't be grabbed, and shown
+// in the tray tooltip.
+var hotkeyLost atomic.Bool
+
+// healthTimeout bounds each -health-every check; a server that doesn't
+// answer in time counts as down.
+const healthTimeout = 5 * time.Second
+
+// serverDown is set while the transcription server is unreachable, and
+// shown in the tray.
+var serverDown atomic.Bool
+
+// safeMode is set while all typing is dropped, and shown in the tray.
+var safeMode atomic.Bool
+
+// typingSlowdown is the extra pause, as a time.Duration, typing backends add
+// after each keystroke. -verify-typing raises it when keystrokes are dropped
+// and lowers it again while phrases come out intact.
+var typingSlowdown atomic.Int64
+
+// hotkeyEvent reports a press or release of the recording hotkey, or a
+// press of the undo, pause, safe mode or flush hotkey.
+type hotkeyEvent struct {
+	pressed bool
+	undo    bool
+	pause   bool
+	safe    bool
+	flush   bool
+}
+
+// TextTyper types transcribed text into the focused window.
+type TextTyper interface {
+	TypeText(text string)
+	// PressKey sends a key combination such as "Return" or "ctrl+BackSpace".
+	PressKey(spec string) error
+}
+
+// parseKeySpec splits a spec like "ctrl+BackSpace" into its modifier names
+// and key name, validating both.
+func parseKeySpec(spec string) ([]string, string, error) {
+	parts := strings.Split(spec, "+")
+	key := parts[len(parts)-1]
+	if _, ok := namedKeys[key]; !ok {
+		return nil, "", fmt.Errorf("unknown key %q in %q", key, spec)
+	}
+	modifiers := parts[:len(parts)-1]
+	for _, modifier := range modifiers {
+		if _, ok := modifierKeys[modifier]; !ok {
+			return nil, "", fmt.Errorf("unknown modifier %q in %q", modifier, spec)
+		}
+	}
+	return modifiers, key, nil
+}
+
+// PrintTyper is the -dry-run TextTyper. It writes text to stdout, showing
+// BackSpace as a terminal erase and other keys by name.
+type PrintTyper struct{}
+
+func (PrintTyper) TypeText(text string) {
+	fmt.Print(text)
+}
+
+func (PrintTyper) PressKey(spec string) error {
+	modifiers, key, err := parseKeySpec(spec)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(modifiers) == 0 && key == "Return":
+		fmt.Println()
+	case len(modifiers) == 0 && key == "Tab":
+		fmt.Print("\t")
+	case len(modifiers) == 0 && key == "BackSpace":
+		fmt.Print("\b \b")
+	default:
+		fmt.Printf("[%s]", spec)
+	}
+	return nil
+}
+
+// TypingQueue is a TextTyper that hands text and key presses to a single
+// goroutine, so slow typing doesn't stall the recording loop. Actions run in
+// the order they were queued. Output is dropped as it comes due while safe
+// mode is on or a password prompt has focus.
+type TypingQueue struct {
+	typer   TextTyper
+	actions chan func()
+	done    chan struct{}
+
+	// State of the queue goroutine: why output is being dropped, if it is,
+	// and how many dropped characters haven't been matched by a dropped
+	// BackSpace. Later backspaces are dropped while any remain, since they
+	// would erase text the user typed instead; leaving stray text on
+	// screen is the safer mistake.
+	blockedBy string
+	withheld  int
+}
+
+func newTypingQueue(typer TextTyper) *TypingQueue {
+	q := &TypingQueue{
+		typer:   typer,
+		actions: make(chan func(), 64),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		for action := range q.actions {
+			action()
+		}
+	}()
+	return q
+}
+
+func (q *TypingQueue) TypeText(text string) {
+	q.actions <- func() {
+		if q.blocked() {
+			q.withheld += utf8.RuneCountInString(text)
+			return
+		}
+		q.typer.TypeText(text)
+		if currentSettings().verify {
+			q.verifyTyped(text)
+		}
+	}
+}
+
+// verifyTyped reads back the text just typed, when the typer can, to catch
+// keystrokes the focused application dropped. On a mismatch it slows typing
+// down and, up to -verify-retries times, erases what arrived and types text
+// again. Text spanning lines can't be selected back reliably, so it isn't
+// checked.
+func (q *TypingQueue) verifyTyped(text string) {
+	reader, ok := q.typer.(interface {
+		ReadBack(n int) (string, error)
+	})
+	if !ok || text == "" || strings.ContainsAny(text, "\n\t") {
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		got, err := reader.ReadBack(utf8.RuneCountInString(text))
+		if err != nil {
+			debugf("Can't verify typed text: %v", err)
+			return
+		}
+		if got == text {
+			// Recover a tenth of the slowdown per intact phrase
+			if slowdown := typingSlowdown.Load(); slowdown > 0 {
+				typingSlowdown.Store(slowdown * 9 / 10)
+			}
+			return
+		}
+
+		arrived := arrivedRunes(got, text)
+		slowdown := min(max(2*time.Duration(typingSlowdown.Load()), minKeyDelay*5), maxTypingSlowdown)
+		typingSlowdown.Store(int64(slowdown))
+		logEvent(slog.LevelWarn, fmt.Sprintf("Typed %q but %d of its keystrokes were dropped; slowing typing by %v per key",
+			text, utf8.RuneCountInString(text)-arrived, slowdown),
+			"dropped", utf8.RuneCountInString(text)-arrived, "slowdown", slowdown)
+		if attempt >= *verifyTry {
+			return
+		}
+		for range arrived {
+			if err := q.typer.PressKey("BackSpace"); err != nil {
+				log.Printf("Erasing mistyped text failed: %v", err)
+				return
+			}
+		}
+		q.typer.TypeText(text)
+	}
+}
+
+// arrivedRunes estimates how many runes of text reached the field, given
+// got, the field's last len(text) runes after typing it. Typed keystrokes
+// can only have been dropped, so what arrived is the longest tail of got
+// that is text with some runes missing; the rest of got was there before.
+func arrivedRunes(got, text string) int {
+	have, want := []rune(got), []rune(text)
+	arrived := 0
+	for i, j := len(have)-1, len(want)-1; i >= 0 && j >= 0; j-- {
+		if have[i] == want[j] {
+			arrived++
+			i--
+		}
+	}
+	return arrived
+}
+
+// PressKey validates spec immediately but presses it asynchronously, so
+// failures from the underlying typer are only logged.
+func (q *TypingQueue) PressKey(spec string) error {
+	if _, _, err := parseKeySpec(spec); err != nil {
+		return err
+	}
+	q.actions <- func() {
+		if q.withheld > 0 && strings.HasSuffix(spec, "BackSpace") {
+			// A word erase such as ctrl+BackSpace can't be matched to a
+			// count, so it is dropped without using any up
+			if spec == "BackSpace" {
+				q.withheld--
+			}
+			return
+		}
+		if q.blocked() {
+			if spec == "Return" || spec == "Tab" {
+				q.withheld++
+			}
+			return
+		}
+		if err := q.typer.PressKey(spec); err != nil {
+			log.Printf("Pressing %q failed: %v", spec, err)
+		}
+	}
+	return nil
+}
+
+// blocked reports whether output must be dropped, logging when that starts
+// and stops.
+func (q *TypingQueue) blocked() bool {
+	reason := ""
+	if safeMode.Load() {
+		reason = "safe mode is on"
+	} else if prompt, ok := passwordPrompt(q.typer); ok {
+		reason = fmt.Sprintf("%s looks like a password prompt", prompt)
+	}
+	if reason != q.blockedBy {
+		if reason == "" {
+			log.Printf("Typing resumed")
+		} else {
+			log.Printf("Not typing: %s", reason)
+			if !safeMode.Load() {
+				notifyError("Typing suppressed", errors.New(reason))
+			}
+		}
+		q.blockedBy = reason
+	}
+	return reason != ""
+}
+
+// passwordPrompts matches the WM_CLASS names of programs that only ask for
+// passwords, and passwordTitles the titles of other windows that do.
+var (
+	passwordPrompts = regexp.MustCompile(`(?i)pinentry|askpass|gcr-prompter|polkit|policykit|keyring`)
+	passwordTitles  = regexp.MustCompile(`(?i)password|passphrase|passwort|contraseña|mot de passe`)
 )
 
-type KeyboardSimulator struct {
-	conn   *xgb.Conn
-	keymap map[rune]byte
+// passwordPrompt reports whether the focused window appears to ask for a
+// password, judging by its WM_CLASS and title, and describes the window.
+// This is best effort: X doesn't say whether the focused input of a browser
+// or toolkit window is a password field, so only whole prompt windows are
+// caught. Typers that can't report the focused window never match.
+func passwordPrompt(typer TextTyper) (string, bool) {
+	if window, ok := typer.(interface {
+		FocusedClass() (string, string, error)
+	}); ok {
+		instance, class, err := window.FocusedClass()
+		if err == nil && (passwordPrompts.MatchString(instance) || passwordPrompts.MatchString(class)) {
+			return fmt.Sprintf("window %q", class), true
+		}
+	}
+	if window, ok := typer.(interface {
+		FocusedTitle() (string, error)
+	}); ok {
+		title, err := window.FocusedTitle()
+		if err == nil && passwordTitles.MatchString(title) {
+			return fmt.Sprintf("window titled %q", title), true
+		}
+	}
+	return "", false
+}
+
+// Close waits for all queued actions to finish.
+func (q *TypingQueue) Close() {
+	close(q.actions)
+	<-q.done
+}
+
+// CommandAction is one step of a spoken command: either a key combination
+// (see PressKey) or literal text typed like a transcribed phrase.
+type CommandAction struct {
+	Key  string `json:"key,omitempty"`
+	Text string `json:"text,omitempty"`
 }
 
-func newKeyboardSimulator() (*KeyboardSimulator, error) {
-	X, err := xgb.NewConn()
+// spokenCommands maps normalized spoken phrases to the actions they trigger.
+var spokenCommands = map[string][]CommandAction{
+	"new line":         {{Key: "Return"}},
+	"new paragraph":    {{Key: "Return"}, {Key: "Return"}},
+	"tab":              {{Key: "Tab"}},
+	"delete that":      {{Key: "ctrl+BackSpace"}},
+	"period":           {{Text: "."}},
+	"full stop":        {{Text: "."}},
+	"comma":            {{Text: ","}},
+	"question mark":    {{Text: "?"}},
+	"exclamation mark": {{Text: "!"}},
+	"colon":            {{Text: ":"}},
+	"semicolon":        {{Text: ";"}},
+}
+
+// loadCommands merges commands from a JSON file, mapping phrases to action
+// lists, over the built-in defaults.
+func loadCommands(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to X server: %w", err)
+		return fmt.Errorf("reading commands file: %w", err)
+	}
+	var commands map[string][]CommandAction
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return fmt.Errorf("parsing commands file: %w", err)
+	}
+	for phrase, actions := range commands {
+		for _, action := range actions {
+			if action.Key == "" {
+				continue
+			}
+			if _, _, err := parseKeySpec(action.Key); err != nil {
+				return fmt.Errorf("command %q: %w", phrase, err)
+			}
+		}
+		spokenCommands[normalizeCommand(phrase)] = actions
+	}
+	return nil
+}
+
+// normalizeCommand lowercases a phrase and drops punctuation so that
+// Whisper output like "New line." matches the "new line" command.
+func normalizeCommand(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = normalizeWord(word)
+	}
+	return strings.Join(strings.Fields(strings.Join(words, " ")), " ")
+}
+
+// spokenModifiers maps spoken modifier names to key spec modifiers.
+var spokenModifiers = map[string]string{
+	"control": "ctrl",
+	"ctrl":    "ctrl",
+	"shift":   "shift",
+	"alt":     "alt",
+	"option":  "alt",
+	"command": "cmd",
+	"cmd":     "cmd",
+}
+
+// spokenKeys maps spoken key names to key spec keys. Single letters and
+// digits are used as-is.
+var spokenKeys = map[string]string{
+	"enter":     "Return",
+	"return":    "Return",
+	"tab":       "Tab",
+	"backspace": "BackSpace",
+	"escape":    "Escape",
+	"delete":    "Delete",
+	"space":     "space",
+	"zero":      "0",
+	"one":       "1",
+	"two":       "2",
+	"three":     "3",
+	"four":      "4",
+	"five":      "5",
+	"six":       "6",
+	"seven":     "7",
+	"eight":     "8",
+	"nine":      "9",
+}
+
+// spokenShortcut parses a phrase like "Press control shift T." into the key
+// spec "ctrl+shift+t". It only matches phrases starting with
+// -shortcut-prefix, so prose that happens to mention a modifier is typed
+// normally, and only when the platform supports every key in the spec.
+func spokenShortcut(text string) (string, bool) {
+	words := strings.Fields(normalizeCommand(text))
+	if *keyPrefix == "" || len(words) < 2 || words[0] != strings.ToLower(*keyPrefix) {
+		return "", false
+	}
+
+	var parts []string
+	for _, word := range words[1 : len(words)-1] {
+		modifier, ok := spokenModifiers[word]
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, modifier)
+	}
+	last := words[len(words)-1]
+	key, ok := spokenKeys[last]
+	if !ok {
+		key = last
+	}
+	spec := strings.Join(append(parts, key), "+")
+	if _, _, err := parseKeySpec(spec); err != nil {
+		return "", false
+	}
+	return spec, true
+}
+
+// spokenCorrection parses a phrase like "Correct that to Kyle." into the
+// replacement "Kyle". It only matches phrases starting with
+// -correction-prefix and followed by at least one word. The replacement
+// keeps the case it was transcribed in, without trailing punctuation.
+func spokenCorrection(text string) (string, bool) {
+	prefix := strings.Fields(normalizeCommand(*fixPrefix))
+	words := strings.Fields(text)
+	if len(prefix) == 0 || len(words) <= len(prefix) ||
+		normalizeCommand(strings.Join(words[:len(prefix)], " ")) != strings.Join(prefix, " ") {
+		return "", false
+	}
+	replacement := strings.TrimRightFunc(strings.Join(words[len(prefix):], " "), unicode.IsPunct)
+	return replacement, replacement != ""
+}
+
+// replaceLastWord returns prev with its last word replaced by replacement.
+// Punctuation and whitespace after the word, such as a sentence's period
+// and the trailing space, stay after the replacement, which is capitalized
+// when the word started a sentence.
+func replaceLastWord(prev, replacement string) (string, bool) {
+	trimmed := strings.TrimRightFunc(prev, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+	if trimmed == "" {
+		return prev, false
+	}
+	start := 0
+	if i := strings.LastIndexFunc(trimmed, unicode.IsSpace); i >= 0 {
+		_, size := utf8.DecodeRuneInString(trimmed[i:])
+		start = i + size
+	}
+	if endsSentence(prev[:start]) {
+		first, size := utf8.DecodeRuneInString(replacement)
+		replacement = string(unicode.ToUpper(first)) + replacement[size:]
+	}
+	return prev[:start] + replacement + prev[len(trimmed):], true
+}
+
+// isCommand reports whether outputPhrase runs text as a command rather than
+// typing it.
+func isCommand(text string) bool {
+	if !currentSettings().commands {
+		return false
+	}
+	_, command := spokenCommands[normalizeCommand(text)]
+	_, shortcut := spokenShortcut(text)
+	_, correction := spokenCorrection(text)
+	return command || shortcut || correction
+}
+
+// outputPhrase runs the spoken command matching text, or types it formatted
+// against prev, the text output so far. It returns the updated prev.
+func outputPhrase(typer TextTyper, prev, text string) string {
+	if !currentSettings().commands {
+		return typeFormatted(typer, prev, text)
+	}
+
+	if spec, ok := spokenShortcut(text); ok {
+		log.Printf("Pressing shortcut: %s", spec)
+		return runActions(typer, prev, text, []CommandAction{{Key: spec}})
+	}
+
+	if replacement, ok := spokenCorrection(text); ok {
+		corrected, ok := replaceLastWord(prev, replacement)
+		if !ok {
+			log.Printf("Nothing to correct")
+			return prev
+		}
+		log.Printf("Correcting last word to %q", replacement)
+		return reconcileText(typer, prev, corrected)
+	}
+
+	actions, ok := spokenCommands[normalizeCommand(text)]
+	if !ok {
+		parts := splitLineBreaks(text)
+		if len(parts) == 1 {
+			return typeFormatted(typer, prev, text)
+		}
+		for _, part := range parts {
+			prev = outputPhrase(typer, prev, part)
+		}
+		return prev
+	}
+
+	log.Printf("Running command: %s", text)
+	return runActions(typer, prev, text, actions)
+}
+
+// runActions runs the actions of the command spoken as text. It returns
+// the updated prev.
+func runActions(typer TextTyper, prev, text string, actions []CommandAction) string {
+	for _, action := range actions {
+		if action.Key == "Return" && strings.HasSuffix(prev, " ") {
+			// Don't leave the previous phrase's trailing space at the end of the line
+			if err := typer.PressKey("BackSpace"); err == nil {
+				prev = prev[:len(prev)-1]
+			}
+		}
+		if action.Key != "" {
+			if err := typer.PressKey(action.Key); err != nil {
+				log.Printf("Command %q failed: %v", text, err)
+				return prev
+			}
+			switch action.Key {
+			case "Return":
+				prev += "\n"
+			case "Tab":
+				prev += "\t"
+			}
+		}
+		if action.Text != "" {
+			prev = typeFormatted(typer, prev, action.Text)
+		}
+	}
+	return prev
+}
+
+// splitLineBreaks splits text around line-break commands spoken inside it,
+// so "Buy milk. New line. Call Bob." yields "Buy milk.", "New line." and
+// "Call Bob.". Only commands made up entirely of Return presses are matched
+// within a phrase; other commands are too likely to be meant literally. The
+// one exception is punctuation spoken right before a line break, as in "buy
+// milk period new line", which is split off too.
+func splitLineBreaks(text string) []string {
+	words := strings.Fields(text)
+	var parts, pending []string
+	for i := 0; i < len(words); {
+		n := lineBreakAt(words[i:])
+		if n == 0 {
+			pending = append(pending, words[i])
+			i++
+			continue
+		}
+		if p := punctuationBefore(pending); p > 0 && p < len(pending) {
+			parts = append(parts, strings.Join(pending[:len(pending)-p], " "))
+			pending = pending[len(pending)-p:]
+		}
+		if len(pending) > 0 {
+			parts = append(parts, strings.Join(pending, " "))
+			pending = nil
+		}
+		parts = append(parts, strings.Join(words[i:i+n], " "))
+		i += n
+	}
+	if len(pending) > 0 || len(parts) == 0 {
+		parts = append(parts, strings.Join(pending, " "))
+	}
+	return parts
+}
+
+// lineBreakAt returns how many leading words of words form a line-break
+// command, preferring the longest match, or 0 if they don't start one.
+func lineBreakAt(words []string) int {
+	for n := len(words); n > 0; n-- {
+		actions, ok := spokenCommands[normalizeCommand(strings.Join(words[:n], " "))]
+		if ok && isLineBreak(actions) {
+			return n
+		}
+	}
+	return 0
+}
+
+// punctuationBefore returns how many trailing words of words form a command
+// that only types text, such as "period", or 0 if they don't end with one.
+func punctuationBefore(words []string) int {
+	for n := len(words); n > 0; n-- {
+		actions, ok := spokenCommands[normalizeCommand(strings.Join(words[len(words)-n:], " "))]
+		if ok && typesTextOnly(actions) {
+			return n
+		}
+	}
+	return 0
+}
+
+// typesTextOnly reports whether actions only type text.
+func typesTextOnly(actions []CommandAction) bool {
+	for _, action := range actions {
+		if action.Key != "" {
+			return false
+		}
+	}
+	return len(actions) > 0
+}
+
+// isLineBreak reports whether actions only press Return.
+func isLineBreak(actions []CommandAction) bool {
+	for _, action := range actions {
+		if action.Key != "Return" || action.Text != "" {
+			return false
+		}
+	}
+	return len(actions) > 0
+}
+
+// typeFormatted types text formatted against prev, followed by its trailing
+// space. A trailing space left by the previous phrase is erased first when
+// text starts with closing punctuation. It returns the updated prev.
+func typeFormatted(typer TextTyper, prev, text string) string {
+	formatted := formatTranscript(prev, text)
+	if formatted == "" {
+		return prev
+	}
+	if strings.HasSuffix(prev, " ") && startsWithAny(formatted, closingPunctuation) {
+		if err := typer.PressKey("BackSpace"); err == nil {
+			prev = prev[:len(prev)-1]
+		}
+	}
+	formatted += trailingSpace(formatted)
+	log.Printf("Typing: %q", formatted)
+	typer.TypeText(formatted)
+	return prev + formatted
+}
+
+// endSentence types -sentence-end after typed unless it is disabled or
+// typed already ends a sentence. The punctuation attaches to the phrase, so
+// the phrase's trailing space is erased first and typed again after it. It
+// returns the updated typed text.
+func endSentence(typer TextTyper, typed string) string {
+	if *sentEnd == "" || endsSentence(typed) {
+		return typed
+	}
+	if strings.HasSuffix(typed, " ") {
+		if err := typer.PressKey("BackSpace"); err != nil {
+			log.Printf("Failed to remove trailing space: %v", err)
+			return typed
+		}
+		typed = typed[:len(typed)-1]
+	}
+	text := *sentEnd + trailingSpace(*sentEnd)
+	log.Printf("Typing: %q", text)
+	typer.TypeText(text)
+	return typed + text
+}
+
+// endLine presses Return after typed for -insert-newline-between-phrases,
+// erasing the phrase's trailing space first, unless the flag is unset or
+// typed is empty or already ends a line. It returns the updated typed text.
+func endLine(typer TextTyper, typed string) string {
+	if !*phraseLine || typed == "" || strings.HasSuffix(typed, "\n") {
+		return typed
+	}
+	if strings.HasSuffix(typed, " ") {
+		if err := typer.PressKey("BackSpace"); err != nil {
+			log.Printf("Failed to remove trailing space: %v", err)
+			return typed
+		}
+		typed = typed[:len(typed)-1]
+	}
+	if err := typer.PressKey("Return"); err != nil {
+		log.Printf("Failed to end line: %v", err)
+		return typed
+	}
+	return typed + "\n"
+}
+
+// sentenceEnders is the punctuation after which a new sentence starts.
+const sentenceEnders = ".?!"
+
+// endsSentence reports whether text is empty or ends a sentence, so the
+// next phrase starts with a capital: with a line break, sentenceEnders, or
+// the -sentence-end punctuation.
+func endsSentence(text string) bool {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if trimmed == "" || strings.HasSuffix(text, "\n") {
+		return true
+	}
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	return strings.ContainsRune(sentenceEnders, last) ||
+		*sentEnd != "" && strings.HasSuffix(trimmed, *sentEnd)
+}
+
+// Punctuation that attaches to the text before or after it rather than
+// being separated by a space.
+const (
+	closingPunctuation = ",.;:!?)]}”’"
+	openingPunctuation = "([{“‘"
+)
+
+// formatTranscript prepares next for typing after prev. It collapses
+// duplicate whitespace, writes numbers as digits with -format-numbers,
+// capitalizes the first letter when next starts a
+// sentence, and adds a leading space unless prev already ends in whitespace
+// or an opening bracket or quote, or next starts with closing punctuation.
+func formatTranscript(prev, next string) string {
+	text := strings.Join(strings.Fields(next), " ")
+	if text == "" {
+		return ""
+	}
+	if *fmtNumbers {
+		text = formatNumbers(text, *numLocale)
+	}
+
+	trimmed := strings.TrimRightFunc(prev, unicode.IsSpace)
+	if endsSentence(prev) {
+		first, size := utf8.DecodeRuneInString(text)
+		text = string(unicode.ToUpper(first)) + text[size:]
+	}
+
+	endsInSpace := trimmed != prev
+	last, _ := utf8.DecodeLastRuneInString(prev)
+	if prev == "" || endsInSpace || startsWithAny(text, closingPunctuation) ||
+		strings.ContainsRune(openingPunctuation, last) {
+		return text
+	}
+	return " " + text
+}
+
+// startsWithAny reports whether the first rune of s is one of chars.
+func startsWithAny(s, chars string) bool {
+	first, _ := utf8.DecodeRuneInString(s)
+	return s != "" && strings.ContainsRune(chars, first)
+}
+
+// trailingSpace returns the space to type after formatted so the cursor is
+// ready for the next phrase, or "" when the typing profile or
+// -no-trailing-space turns it off or formatted
+// ends in whitespace or an opening bracket or quote.
+func trailingSpace(formatted string) string {
+	if !currentSettings().trailingSpace || formatted == "" {
+		return ""
+	}
+	last, _ := utf8.DecodeLastRuneInString(formatted)
+	if unicode.IsSpace(last) || strings.ContainsRune(openingPunctuation, last) {
+		return ""
+	}
+	return " "
+}
+
+// SubtitleTrack collects the timed segments of a recording session for
+// -save-srt. Times are relative to the start of the session.
+type SubtitleTrack struct {
+	segments []Segment
+}
+
+// Add appends segments from a clip that started at offset into the session.
+// Segments ending before the last one already added, as happens when a
+// forced flush carries audio into the next phrase, are skipped.
+func (t *SubtitleTrack) Add(offset time.Duration, segments []Segment) {
+	for _, segment := range segments {
+		segment.Start += offset
+		segment.End += offset
+		if n := len(t.segments); n > 0 {
+			last := t.segments[n-1].End
+			if segment.End <= last {
+				continue
+			}
+			segment.Start = max(segment.Start, last)
+		}
+		if segment.Text != "" {
+			t.segments = append(t.segments, segment)
+		}
+	}
+}
+
+// WriteSRT writes the collected segments to path in SubRip format.
+func (t *SubtitleTrack) WriteSRT(path string) error {
+	var b strings.Builder
+	for i, segment := range t.segments {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1,
+			formatSRTTime(segment.Start), formatSRTTime(segment.End), segment.Text)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("writing subtitles: %w", err)
+	}
+	return nil
+}
+
+// formatSRTTime formats d as an SRT timestamp, HH:MM:SS,mmm.
+func formatSRTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// Stats counts captured chunks and transcription requests. Recording,
+// transcription and the status API run on different goroutines, so all
+// access goes through mu.
+type Stats struct {
+	mu             sync.Mutex
+	chunks         int
+	transcriptions int
+	samples        int
+	requests       int
+	failures       int
+	latency        time.Duration // Total over successful requests
+}
+
+func (s *Stats) recordChunk() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks++
+}
+
+// recordRequest counts one HTTP attempt and how long it took.
+func (s *Stats) recordRequest(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if failed {
+		s.failures++
+		return
+	}
+	s.latency += latency
+}
+
+// recordTranscription counts a successfully transcribed clip of samples.
+func (s *Stats) recordTranscription(samples int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transcriptions++
+	s.samples += samples
+}
+
+// Summary describes the counters so far, timing audio in config's format.
+func (s *Stats) Summary(config AudioConfig) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var average time.Duration
+	if succeeded := s.requests - s.failures; succeeded > 0 {
+		average = s.latency / time.Duration(succeeded)
+	}
+	return fmt.Sprintf("%d chunks, %d transcriptions of %v audio, %d requests (%d failed), average latency %v",
+		s.chunks, s.transcriptions, config.durationOf(s.samples).Round(time.Millisecond),
+		s.requests, s.failures, average.Round(time.Millisecond))
+}
+
+// TranscriptLog appends timestamped phrases to a file, reopening it when a
+// write fails so that log rotation doesn't silently drop history.
+type TranscriptLog struct {
+	path string
+	file *os.File
+}
+
+func openTranscriptLog(path string) (*TranscriptLog, error) {
+	l := &TranscriptLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *TranscriptLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening transcript log: %w", err)
+	}
+	l.file = file
+	return nil
+}
+
+// Append writes a phrase prefixed with an RFC3339 timestamp.
+func (l *TranscriptLog) Append(text string) error {
+	line := fmt.Sprintf("%s %s\n", time.Now().Format(time.RFC3339), text)
+	if err := l.write(line); err != nil {
+		// The file may have been rotated or removed; reopen and try once more.
+		l.file.Close()
+		if err := l.open(); err != nil {
+			return err
+		}
+		return l.write(line)
+	}
+	return nil
+}
+
+func (l *TranscriptLog) write(line string) error {
+	if _, err := l.file.WriteString(line); err != nil {
+		return fmt.Errorf("writing transcript log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("syncing transcript log: %w", err)
+	}
+	return nil
+}
+
+// configSkipFlags are flags that are never read from or written to the
+// config file: one-shot actions and secrets that default from the environment.
+var configSkipFlags = map[string]bool{
+	"list-devices":   true,
+	"calibrate":      true,
+	"calibrate-save": true,
+	"file":           true,
+	"once":           true,
+	"stdin":          true,
+	"token":          true,
+}
+
+// configPath returns $XDG_CONFIG_HOME/whispertype/config.json.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding config directory: %w", err)
+	}
+	return filepath.Join(dir, "whispertype", "config.json"), nil
+}
+
+// loadConfig applies flag values from the config file, creating an empty
+// one if it doesn't exist. It must run before flag.Parse so that flags
+// given on the command line override the file. Unknown options are skipped
+// with a warning, so a config written for another version still loads.
+func loadConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := writeDefaultConfig(path); err != nil {
+			return err
+		}
+		log.Printf(`Created config at %s; set options by flag name, e.g. {"language": "en"}`, path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	for name, raw := range values {
+		if configSkipFlags[name] {
+			log.Printf("Warning: config %s: option %q can only be given on the command line, ignoring it", path, name)
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			log.Printf("Warning: config %s: ignoring unknown option %q", path, name)
+			continue
+		}
+		value := string(raw)
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			value = str
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config %s: option %q: %w", path, name, err)
+		}
+	}
+	log.Printf("Loaded config from %s", path)
+	return nil
+}
+
+// writeDefaultConfig writes a config file setting no options. Only the
+// options a user adds are kept in it, so the rest follow the defaults of
+// whichever version is running.
+func writeDefaultConfig(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating config directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte("{}\n"), 0o644); err != nil {
+		return fmt.Errorf("writing default config: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	if *listDevs {
+		if err := listDevices(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	audioConfig = AudioConfig{SampleRate: *rate, Channels: *numChans, BitsPerSample: 16}
+	if err := audioConfig.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *logFile != "" {
+		var err error
+		transcriptLog, err = openTranscriptLog(*logFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *energyCSV != "" {
+		var err error
+		energyLog, err = openEnergyDump(*energyCSV)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer energyLog.Close()
+	}
+
+	if err := validateFlags(); err != nil {
+		log.Fatal(err)
+	}
+	safeMode.Store(*safeStart)
+
+	if *calibrate {
+		if err := calibrateThreshold(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *realtime && *streaming {
+		log.Printf("Both -realtime and -streaming set, using -realtime")
+	}
+
+	if *mode != "toggle" && *mode != "ptt" {
+		log.Fatalf("Unknown mode %q (expected toggle or ptt)", *mode)
+	}
+
+	if err := validateLanguage(*language); err != nil {
+		log.Fatal(err)
+	}
+
+	if *filterFile != "" {
+		if err := loadFilters(*filterFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *commands != "" {
+		if err := loadCommands(*commands); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *profiles != "" {
+		if err := loadProfiles(*profiles); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, ok := uploadFormats[*encoding]; !ok {
+		log.Fatalf("Unknown encoding %q (expected wav, flac or opus)", *encoding)
+	}
+	if *encoding != "wav" {
+		var err error
+		encoder, err = resolveEncoder(*encoding)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Encoding uploads as %s with %s", *encoding, encoder[0])
+	}
+
+	switch *serverType {
+	case "auto", "whisper", "faster-whisper":
+	default:
+		log.Fatalf("Unknown server type %q (expected auto, whisper or faster-whisper)", *serverType)
+	}
+
+	switch *apiKind {
+	case "whispercpp":
+	case "openai":
+		if *apiToken == "" {
+			log.Printf("Warning: openai API selected but no token set (use -token or WHISPER_API_KEY)")
+		}
+	default:
+		log.Fatalf("Unknown API %q (expected whispercpp or openai)", *apiKind)
+	}
+
+	// The transcription backend, selected by -stream-url
+	promptText, err := buildPrompt(*prompt, *promptFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := newClient(audioConfig, promptText)
+	var transcriber Transcriber = client
+	if *streamURL != "" {
+		stream, err := newWebsocketTranscriber(*streamURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transcriber = stream
+	}
+
+	if *inputFile != "" {
+		if err := transcribeFile(transcriber, *inputFile, audioConfig); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *readStdin {
+		if err := transcribeStdin(transcriber); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *once {
+		if err := recordOnce(transcriber); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *warmUp && *apiKind == "whispercpp" && *streamURL == "" {
+		if err := warmUpServer(client, *waitServer); err != nil {
+			log.Fatalf("Whisper server at %s is unreachable: %v (is it running? use -wait-server to wait for it)", strings.Join(client.servers, ", "), err)
+		}
+	}
+
+	// Flush the current phrase before exiting on SIGINT/SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	systray.Run(func() { onReady(transcriber, signals) }, onExit)
+}
+
+func onReady(transcriber Transcriber, signals <-chan os.Signal) {
+	// Try setting a default icon first
+	systray.SetIcon(iconOff)
+	systray.SetTitle("WhisperType")
+	systray.SetTooltip(tooltip("inactive"))
+
+	mToggle := systray.AddMenuItem("Start Recording", "Start or stop recording")
+	mStatus := systray.AddMenuItem("", "Transcription server and phrase count")
+	mStatus.Disable()
+	mRegrab := systray.AddMenuItem("Re-grab Hotkey", "Grab the recording hotkey again after another application took it")
+	systray.AddSeparator()
+	mQuit := systray.AddMenuItem("Quit", "Quit WhisperType")
+
+	typer, hotkeys, err := setupInput()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		log.Printf("Dry run: printing phrases instead of typing them")
+		typer = PrintTyper{}
+	}
+
+	// Handle quit from menu
+	go func() {
+		<-mQuit.ClickedCh
+		systray.Quit()
+	}()
+
+	recorder := &Recorder{
+		typer:         typer,
+		transcriber:   transcriber,
+		toggleItem:    mToggle,
+		statusItem:    mStatus,
+		undoRequests:  make(chan struct{}, 1),
+		flushRequests: make(chan struct{}, 1),
+	}
+	recorder.updateMenu()
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		recorder.Shutdown(shutdownTimeout)
+		systray.Quit()
+	}()
+
+	// Handle start/stop from menu
+	go func() {
+		for range mToggle.ClickedCh {
+			recorder.Toggle()
+		}
+	}()
+
+	if hotkeys.regrab == nil {
+		mRegrab.Hide()
+	} else {
+		recorder.setHotkeyLost(hotkeys.regrab() != nil)
+		go func() {
+			ticker := time.NewTicker(hotkeyRegrabInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-mRegrab.ClickedCh:
+					log.Printf("Re-grabbing hotkey")
+				}
+				recorder.setHotkeyLost(hotkeys.regrab() != nil)
+			}
+		}()
+	}
+	if client, ok := transcriber.(*Client); ok && *healthInt > 0 {
+		go recorder.monitorServer(client, *healthInt)
+	}
+	if *apiPort != 0 {
+		go func() {
+			if err := serveAPI(*apiPort, recorder); err != nil {
+				log.Printf("API server error: %v", err)
+			}
+		}()
+	}
+
+	// In push-to-talk mode a release only stops recording if no press of the
+	// hotkey follows within autoRepeatDebounce, since X auto-repeat delivers
+	// release/press pairs while the key is held.
+	var releaseTimer <-chan time.Time
+
+	// A press of a hotkey within -hotkey-debounce of its previous press is
+	// bounce or auto-repeat, and would undo the toggle it follows. The
+	// window runs from every press, so a stream of repeats stays inside it.
+	lastPress := make(map[hotkeyEvent]time.Time)
+	bounced := func(ev hotkeyEvent) bool {
+		now := time.Now()
+		last := lastPress[ev]
+		lastPress[ev] = now
+		return now.Sub(last) < *debounce
+	}
+
+	// Handle key events
+	for {
+		select {
+		case <-releaseTimer:
+			releaseTimer = nil
+			recorder.Stop()
+
+		case ev := <-hotkeys.events:
+			// Push-to-talk presses only keep recording going, so repeats
+			// of them are harmless and cancel the pending release
+			pttPress := *mode == "ptt" && ev == (hotkeyEvent{pressed: true})
+			if ev.pressed && !pttPress && bounced(ev) {
+				debugf("Ignoring hotkey press within %v of the last", *debounce)
+				continue
+			}
+			switch {
+			case ev.undo:
+				go recorder.Undo()
+			case ev.pause:
+				recorder.TogglePause()
+			case ev.safe:
+				recorder.ToggleSafeMode()
+			case ev.flush:
+				recorder.Flush()
+			case ev.pressed && *mode == "ptt":
+				releaseTimer = nil
+				recorder.Start()
+			case ev.pressed:
+				recorder.Toggle()
+			case *mode == "ptt" && recorder.Active():
+				releaseTimer = time.After(autoRepeatDebounce)
+			}
+		}
+	}
+}
+
+// Recorder owns the recording session state, which is shared between the
+// hotkey handler and the HTTP API.
+type Recorder struct {
+	typer       TextTyper
+	transcriber Transcriber
+	source      audioSource // Captures with recordLoop when nil
+	toggleItem  *systray.MenuItem
+	statusItem  *systray.MenuItem
+
+	mu             sync.Mutex
+	active         bool
+	paused         bool // Chunks are dropped, keeping the phrase so far
+	session        context.Context
+	cancel         context.CancelFunc
+	done           chan struct{} // Closed when the current session's run returns
+	lastTranscript string
+	transcript     string // Text typed in the current or last session
+	phraseCount    int
+
+	// lastEdit is the most recent phrase's change to the typed text, which
+	// Undo reverts. undoRequests hands undo to run while a session is active
+	// so it stays in order with typing.
+	lastEdit     *textEdit
+	undoRequests chan struct{}
+
+	// flushRequests asks run to end the phrase being recorded with
+	// -manual-flush. It is nil for recorders that can't receive requests.
+	flushRequests chan struct{}
+}
+
+// textEdit is a change to the typed text: before and after are the text
+// typed in the session before and after the change.
+type textEdit struct {
+	before string
+	after  string
+}
+
+// RecorderStatus is the JSON body served by the /status endpoint.
+type RecorderStatus struct {
+	Active         bool   `json:"active"`
+	Paused         bool   `json:"paused"`
+	SafeMode       bool   `json:"safeMode"`
+	LastTranscript string `json:"lastTranscript"`
+	Transcript     string `json:"transcript"`
+	PhraseCount    int    `json:"phraseCount"`
+}
+
+// Start begins a recording session if one isn't already running.
+func (r *Recorder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start()
+}
+
+// Stop ends the current recording session, if any.
+func (r *Recorder) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stop()
+}
+
+// Toggle starts recording when idle and stops it when active.
+func (r *Recorder) Toggle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active {
+		r.stop()
+	} else {
+		r.start()
+	}
+}
+
+// Shutdown stops the current session and waits up to timeout for it to
+// transcribe its buffered phrase.
+func (r *Recorder) Shutdown(timeout time.Duration) {
+	r.mu.Lock()
+	r.stop()
+	done := r.done
+	r.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for the final transcription")
+	}
+}
+
+// Flush ends the phrase being recorded with -manual-flush, transcribing and
+// typing it. It does nothing without an active session.
+func (r *Recorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.active {
+		log.Printf("Not recording, nothing to flush")
+		return
+	}
+	select {
+	case r.flushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// TogglePause pauses the current session, keeping its buffered phrase, or
+// resumes it if already paused. Without a session there is nothing to
+// pause.
+func (r *Recorder) TogglePause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.active {
+		log.Printf("Not recording, nothing to pause")
+		return
+	}
+	r.paused = !r.paused
+	if r.paused {
+		log.Printf("Recording paused")
+	} else {
+		log.Printf("Recording resumed")
+	}
+	systray.SetTooltip(tooltip(r.state()))
+	r.updateMenu()
+}
+
+// ToggleSafeMode turns safe mode on, dropping all typing including text
+// already queued, or back off.
+func (r *Recorder) ToggleSafeMode() {
+	if safeMode.Load() {
+		safeMode.Store(false)
+		log.Printf("Safe mode off, typing resumed")
+	} else {
+		safeMode.Store(true)
+		log.Printf("Safe mode on, typing halted")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	systray.SetTooltip(tooltip(r.state()))
+}
+
+// Paused reports whether the current session is paused.
+func (r *Recorder) Paused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+// state names the recording state for the tray tooltip. The caller must
+// hold r.mu.
+func (r *Recorder) state() string {
+	switch {
+	case r.paused:
+		return "paused"
+	case r.active:
+		return "active"
+	default:
+		return "inactive"
+	}
+}
+
+// Active reports whether a recording session is running.
+func (r *Recorder) Active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active
+}
+
+// Status returns a snapshot of the recording state.
+func (r *Recorder) Status() RecorderStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RecorderStatus{
+		Active:         r.active,
+		Paused:         r.paused,
+		SafeMode:       safeMode.Load(),
+		LastTranscript: r.lastTranscript,
+		Transcript:     r.transcript,
+		PhraseCount:    r.phraseCount,
+	}
+}
+
+// Undo deletes the most recently typed phrase. It only works right after
+// the phrase: once more text is typed, or after one undo, there is nothing
+// to revert. Keys typed by hand in between aren't noticed.
+func (r *Recorder) Undo() {
+	r.mu.Lock()
+	if r.active {
+		select {
+		case r.undoRequests <- struct{}{}:
+		default:
+		}
+		r.mu.Unlock()
+		return
+	}
+	done := r.done
+	r.mu.Unlock()
+
+	// Let a stopping session finish typing its final phrase first
+	if done != nil {
+		<-done
+	}
+	if edit := r.takeEdit(); edit != nil {
+		log.Printf("Undoing %q", strings.TrimPrefix(edit.after, edit.before))
+		r.setTranscript(reconcileText(r.typer, edit.after, edit.before))
+	}
+}
+
+// undo reverts the last edit for run, whose typed text is typed, and
+// returns the updated typed text. The edit is dropped if typed has changed
+// since.
+func (r *Recorder) undo(typer TextTyper, typed string) string {
+	edit := r.takeEdit()
+	if edit == nil || edit.after != typed {
+		log.Printf("Nothing to undo")
+		return typed
+	}
+	log.Printf("Undoing %q", strings.TrimPrefix(edit.after, edit.before))
+	typed = reconcileText(typer, edit.after, edit.before)
+	r.setTranscript(typed)
+	return typed
+}
+
+func (r *Recorder) takeEdit() *textEdit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	edit := r.lastEdit
+	r.lastEdit = nil
+	return edit
+}
+
+// recordEdit makes the change from before to after the one Undo reverts.
+func (r *Recorder) recordEdit(before, after string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastEdit = &textEdit{before: before, after: after}
+	r.transcript = after
+}
+
+// extendEdit folds a follow-up change from prev to next, such as the period
+// ending a sentence, into the last edit so undo reverts both.
+func (r *Recorder) extendEdit(prev, next string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastEdit != nil && r.lastEdit.after == prev {
+		r.lastEdit.after = next
+	}
+	if r.transcript == prev {
+		r.transcript = next
+	}
+}
+
+// setTranscript records text as the session's typed text for /status.
+func (r *Recorder) setTranscript(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transcript = text
+}
+
+// addPhrase records a transcribed phrase for status reporting.
+func (r *Recorder) addPhrase(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastTranscript = text
+	r.phraseCount++
+	r.updateMenu()
+}
+
+// updateMenu refreshes the systray menu items from the current state. The
+// caller must hold r.mu, except during construction. A recorder without a
+// tray, as used by -stdin, has no menu items.
+func (r *Recorder) updateMenu() {
+	if r.toggleItem == nil {
+		return
+	}
+	if r.active {
+		r.toggleItem.SetTitle("Stop Recording")
+	} else {
+		r.toggleItem.SetTitle("Start Recording")
+	}
+
+	server := transcriptionURL()
+	if client, ok := r.transcriber.(*Client); ok {
+		server = client.server()
+	}
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	if serverDown.Load() {
+		server += " (unreachable)"
+	}
+	status := fmt.Sprintf("Server: %s · %d phrases", server, r.phraseCount)
+	if r.paused {
+		status += " · paused"
+	}
+	r.statusItem.SetTitle(status)
+}
+
+func (r *Recorder) start() {
+	if r.active {
+		return
+	}
+	systray.SetTemplateIcon(iconOn, iconOn)
+	systray.SetTooltip(tooltip("active"))
+	playCue(soundStart)
+
+	if client, ok := r.transcriber.(interface{ ResetLanguage() }); ok {
+		client.ResetLanguage()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.session = ctx
+	r.cancel = cancel
+	r.done = done
+	r.transcript = ""
+	go func() {
+		defer close(done)
+		if err := run(ctx, r); err != nil {
+			log.Printf("Error: %v", err)
+			notifyError("Recording stopped", err)
+		}
+		r.finished(ctx)
+	}()
+	r.active = true
+	r.updateMenu()
+}
+
+// finished marks the recorder inactive when the session run by ctx ends on
+// its own, e.g. because capture could not be restarted or -idle-timeout
+// passed without speech.
+func (r *Recorder) finished(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active && r.session == ctx {
+		r.stop()
+	}
+}
+
+func (r *Recorder) stop() {
+	if !r.active {
+		return
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	systray.SetIcon(iconOff)
+	systray.SetTooltip(tooltip("inactive"))
+	playCue(soundStop)
+	r.active = false
+	r.paused = false
+	r.updateMenu()
+}
+
+// serveAPI serves the local status/control API, and the web UI using it,
+// on localhost.
+func serveAPI(port int, recorder *Recorder) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	log.Printf("Serving API on http://%s", addr)
+	return http.ListenAndServe(addr, apiHandler(recorder))
+}
+
+// apiHandler routes the status/control API and the web UI.
+func apiHandler(recorder *Recorder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeStatus(w, recorder)
+	})
+	mux.HandleFunc("/toggle", controlHandler(recorder, recorder.Toggle))
+	mux.HandleFunc("/undo", controlHandler(recorder, recorder.Undo))
+	mux.HandleFunc("/pause", controlHandler(recorder, recorder.TogglePause))
+	mux.HandleFunc("/safe", controlHandler(recorder, recorder.ToggleSafeMode))
+	mux.HandleFunc("/flush", controlHandler(recorder, recorder.Flush))
+	mux.HandleFunc("/config", serveConfig)
+	mux.Handle("/{$}", serveWebUI())
+	return mux
+}
+
+// controlHandler runs action for a POST and responds with the new status.
+// Like /config it only accepts requests declaring a JSON body, so other
+// pages the user visits can't start recording with a plain form post.
+func controlHandler(recorder *Recorder, action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isJSONRequest(req) {
+			http.Error(w, "expected a JSON request", http.StatusUnsupportedMediaType)
+			return
+		}
+		action()
+		writeStatus(w, recorder)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, recorder *Recorder) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recorder.Status()); err != nil {
+		log.Printf("Failed to write status: %v", err)
+	}
+}
+
+// showLevel adds meter to the tray tooltip while the session run by ctx is
+// still active, so a late update can't overwrite the inactive tooltip.
+func (r *Recorder) showLevel(ctx context.Context, meter *levelMeter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active && !r.paused && r.session == ctx {
+		systray.SetTooltip(tooltip("active") + " " + meter.String())
+	}
+}
+
+// setHotkeyLost records whether the recording hotkey is grabbed, logging
+// and showing changes in the tray.
+func (r *Recorder) setHotkeyLost(lost bool) {
+	if hotkeyLost.Swap(lost) == lost {
+		return
+	}
+	if lost {
+		log.Printf("Warning: hotkey %q is unavailable, another application may have grabbed it", *hotkeySpec)
+	} else {
+		log.Printf("Hotkey %q grabbed", *hotkeySpec)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	systray.SetTooltip(tooltip(r.state()))
+}
+
+// monitorServer checks client's server every interval, recording whether
+// it is reachable.
+func (r *Recorder) monitorServer(client *Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.setServerDown(client.checkHealth())
+	}
+}
+
+// setServerDown records whether the transcription server is reachable, err
+// being why it isn't, and logs and shows changes in the tray.
+func (r *Recorder) setServerDown(err error) {
+	down := err != nil
+	if serverDown.Swap(down) == down {
+		return
+	}
+	if down {
+		logEvent(slog.LevelWarn, fmt.Sprintf("Transcription server is unreachable: %v", err), "error", err)
+		notifyError("Transcription server unreachable", err)
+	} else {
+		log.Printf("Transcription server is reachable again")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.toggleItem == nil {
+		return
+	}
+	systray.SetTooltip(tooltip(r.state()))
+	r.updateMenu()
+}
+
+// tooltip returns the tray tooltip for the given recording state.
+func tooltip(state string) string {
+	if *dryRun {
+		state += ", dry run"
+	}
+	if hotkeyLost.Load() {
+		state += ", hotkey unavailable"
+	}
+	if serverDown.Load() {
+		state += ", server unreachable"
+	}
+	if safeMode.Load() {
+		state += ", safe mode"
+	}
+	return fmt.Sprintf("Speech-to-text (%s)", state)
+}
+
+// notifyInterval is the minimum time between desktop notifications, so a
+// flapping server doesn't produce a stream of them.
+const notifyInterval = 30 * time.Second
+
+// lastNotified is when notifyError last showed a notification.
+var lastNotified struct {
+	sync.Mutex
+	at time.Time
+}
+
+// notifyError shows a desktop notification with summary and err in the
+// background. It does nothing when -notify is disabled, no notifier is
+// installed, or a notification was shown within notifyInterval.
+func notifyError(summary string, err error) {
+	if !*notify {
+		return
+	}
+	lastNotified.Lock()
+	if time.Since(lastNotified.at) < notifyInterval {
+		lastNotified.Unlock()
+		return
+	}
+	lastNotified.at = time.Now()
+	lastNotified.Unlock()
+
+	go func() {
+		name, args := notifyCommand("WhisperType: "+summary, err.Error())
+		if _, err := exec.LookPath(name); err != nil {
+			debugf("Not showing notification: %v", err)
+			return
+		}
+		if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			log.Printf("Failed to show notification with %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+		}
+	}()
+}
+
+// playCue plays an embedded WAV through paplay or pw-play in the background.
+// It does nothing when -sounds is disabled or no player is installed.
+func playCue(sound []byte) {
+	if !*sounds {
+		return
+	}
+	go func() {
+		var player string
+		for _, candidate := range cuePlayers {
+			if _, err := exec.LookPath(candidate); err == nil {
+				player = candidate
+				break
+			}
+		}
+		if player == "" {
+			return
+		}
+
+		file, err := os.CreateTemp("", "whispertype-*.wav")
+		if err != nil {
+			log.Printf("Failed to create sound file: %v", err)
+			return
+		}
+		defer os.Remove(file.Name())
+		_, err = file.Write(sound)
+		file.Close()
+		if err != nil {
+			log.Printf("Failed to write sound file: %v", err)
+			return
+		}
+
+		if err := exec.Command(player, file.Name()).Run(); err != nil {
+			log.Printf("Failed to play sound with %s: %v", player, err)
+		}
+	}()
+}
+
+func onExit() {
+	// Cleanup code here
+}
+
+// interimResult is an interim transcription in streaming mode, tagged so
+// responses arriving after a newer one or after their phrase was committed
+// are discarded.
+type interimResult struct {
+	seq    int // Order the request was sent in
+	phrase int // Phrase the audio belonged to
+	text   string
+	err    error
+}
+
+// session is the state of a recording session in run: the phrase being
+// recorded, the silence that will end it and the text typed so far.
+type session struct {
+	recorder    *Recorder
+	transcriber Transcriber
+	// Types on a separate goroutine so the loop keeps draining audio
+	typer *TypingQueue
+
+	// -threshold, -pause and -sentence-pause can change through /config
+	// while recording, so they are read for each chunk
+	tuned    tuning
+	detector *silenceDetector
+	filter   *audioFilter
+
+	maxPhraseSamples int
+	overlapSamples   int
+
+	phraseBuffer    []int16
+	transcriptLines []string
+	silenceStart    time.Time
+	typed           string // Output so far, used to format the next phrase
+	sentenceEnded   bool   // Whether the current silence already ended a sentence
+	carriedWords    []string
+	contextTail     []int16 // End of the previous phrase, kept for -phrase-context
+
+	// Session position, in samples, of the audio read so far and of the
+	// start of phraseBuffer, used to time subtitle segments.
+	sessionSamples int
+	phraseStart    int
+	subtitles      SubtitleTrack
+
+	meter levelMeter // Smoothed input level shown in the tray tooltip
+
+	// Speech held back until -min-speech-chunks consecutive chunks
+	// confirm a phrase is starting, and how many chunks it spans.
+	onset       []int16
+	onsetChunks int
+
+	// Streaming mode state: the interim text typed for the phrase in
+	// progress and the chunks received since it was last updated.
+	interim            string
+	chunksSinceInterim int
+
+	// Interim transcriptions run in the background: the sequence number
+	// of the last one sent and the last one typed, how many are still
+	// in flight, and the number of phrases committed so far. Results
+	// arrive on interimResults, which is buffered so requests still in
+	// flight when the session ends don't block forever.
+	interimSeq     int
+	interimShown   int
+	interimPending int
+	phraseCount    int
+	interimResults chan interimResult
+	// Context of the interim requests for the phrase in progress, canceled
+	// so the transcription committing it doesn't wait for their slots.
+	interimCtx     context.Context
+	cancelInterims context.CancelFunc
+
+	// Realtime mode state: the end of the previous speech chunk, sent
+	// again with the next one so words cut at the boundary aren't lost,
+	// and that chunk's words, used to drop what the overlap repeats.
+	realtimeTail  []int16
+	realtimeWords []string
+
+	spooled []string // Phrases saved to -spool-dir, oldest first
+
+	// Whether the session is paused, and the timestamp of the first
+	// chunk dropped while it was.
+	paused   bool
+	pausedAt time.Time
+}
+
+// newSession returns a session typing with recorder's typer, whose queue
+// the caller closes once the session is over.
+func newSession(recorder *Recorder) (*session, error) {
+	tuned := currentTuning()
+	detector, err := newSilenceDetector(tuned.threshold)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		recorder:         recorder,
+		transcriber:      recorder.transcriber,
+		typer:            newTypingQueue(recorder.typer),
+		tuned:            tuned,
+		detector:         detector,
+		filter:           newAudioFilter(*highPass, audioConfig),
+		maxPhraseSamples: audioConfig.samplesIn(*maxPhrase),
+		overlapSamples:   audioConfig.samplesIn(chunkOverlap),
+		interimResults:   make(chan interimResult, *maxReqs),
+	}, nil
+}
+
+func run(ctx context.Context, recorder *Recorder) error {
+	if stream, ok := recorder.transcriber.(StreamingTranscriber); ok {
+		return runStreaming(ctx, recorder, stream)
+	}
+
+	s, err := newSession(recorder)
+	if err != nil {
+		return err
+	}
+	// Restore keycodes rebound for characters outside the keymap. Deferred
+	// before closing the queue so queued text finishes typing first.
+	if keyboard, ok := recorder.typer.(interface{ ResetRemaps() }); ok {
+		defer keyboard.ResetRemaps()
+	}
+	defer s.typer.Close()
+
+	audioChan := recorder.capture(ctx)
+	restarts := 0 // Consecutive capture restarts without a chunk in between
+	for {
+		select {
+		case <-ctx.Done():
+			return s.finish()
+		case <-recorder.undoRequests:
+			s.undo()
+		case <-recorder.flushRequests:
+			if s.flush(ctx) {
+				return s.finish()
+			}
+		case result := <-s.interimResults:
+			s.showInterim(result)
+		default:
+		}
+
+		chunk, ok, closed := readNextChunk(audioChan)
+		if closed {
+			if ctx.Err() != nil {
+				continue
+			}
+			if *readStdin {
+				return s.finish()
+			}
+			restarts++
+			if restarts > maxCaptureRestarts {
+				return fmt.Errorf("audio capture stopped after %d restart attempts", maxCaptureRestarts)
+			}
+			logEvent(slog.LevelWarn, fmt.Sprintf("Audio capture stopped, restarting (attempt %d/%d)", restarts, maxCaptureRestarts),
+				"attempt", restarts, "max_attempts", maxCaptureRestarts)
+			time.Sleep(time.Duration(restarts) * time.Second)
+			audioChan = recorder.capture(ctx)
+			continue
+		}
+		if !ok {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		restarts = 0
+
+		done := s.handleChunk(ctx, chunk)
+		// The chunk's samples were copied wherever they were kept, so its
+		// buffer can go back to recordLoop.
+		releaseSamples(chunk.data)
+		if done {
+			return s.finish()
+		}
+	}
+}
+
+// undo reverts the last phrase typed. Interim text isn't part of typed, so
+// while some is shown undo would miscount and does nothing.
+func (s *session) undo() {
+	if s.interim == "" {
+		s.typed = s.recorder.undo(s.typer, s.typed)
+	}
+}
+
+// flush ends the phrase being recorded on a -manual-flush request. It
+// reports whether the session is over, as with -once.
+func (s *session) flush(ctx context.Context) bool {
+	if len(s.phraseBuffer) == 0 {
+		log.Printf("No speech to flush")
+		return false
+	}
+	if err := s.flushPhrase(ctx, 0); err != nil {
+		if ctx.Err() == nil {
+			logEvent(slog.LevelError, fmt.Sprintf("Transcription error, keeping buffered audio: %v", err),
+				"error", err, "phrase_ms", audioConfig.durationOf(len(s.phraseBuffer)).Milliseconds())
+			notifyError("Transcription failed", err)
+		}
+		return false
+	}
+	s.endLine()
+	return *once && s.typed != ""
+}
+
+// showInterim types an interim transcription over the previous one, unless
+// a newer one was typed already or its phrase has been committed.
+func (s *session) showInterim(result interimResult) {
+	s.interimPending--
+	switch {
+	case errors.Is(result.err, context.Canceled):
+		debugf("Interim transcription %d canceled", result.seq)
+	case result.err != nil:
+		logEvent(slog.LevelError, fmt.Sprintf("Interim transcription error: %v", result.err), "error", result.err)
+	case result.phrase != s.phraseCount || result.seq < s.interimShown:
+		debugf("Discarding stale interim transcription %d", result.seq)
+	default:
+		s.interimShown = result.seq
+		selectProfile(s.recorder.typer)
+		formatted := formatTranscript(s.typed, s.dropCarried(result.text))
+		s.interim = reconcileText(s.typer, s.interim, formatted+trailingSpace(formatted))
+	}
+}
+
+// endLine ends the line after the phrase typed last, folding the change
+// into its undo.
+func (s *session) endLine() {
+	ended := endLine(s.typer, s.typed)
+	s.recorder.extendEdit(s.typed, ended)
+	s.typed = ended
+}
+
+// handleChunk processes a captured chunk: it detects silence, buffers
+// speech, and transcribes and types phrases as pauses end them. It reports
+// whether the session is over, as when -once has typed its phrase.
+func (s *session) handleChunk(ctx context.Context, chunk AudioChunk) bool {
+	// Paused audio is dropped; the phrase so far stays buffered, and the
+	// time spent paused doesn't count as silence.
+	if s.recorder.Paused() {
+		if !s.paused {
+			s.paused, s.pausedAt = true, chunk.timestamp
+		}
+		return false
+	}
+	if s.paused {
+		s.paused = false
+		if !s.silenceStart.IsZero() {
+			s.silenceStart = s.silenceStart.Add(chunk.timestamp.Sub(s.pausedAt))
+		}
+	}
+
+	s.sessionSamples += len(chunk.data)
+	stats.recordChunk()
+	// Detection works on filtered audio; what is transcribed stays raw
+	// unless -filter-audio is set.
+	filtered := s.filter.apply(chunk.data)
+	audio := chunk.data
+	if *filterAud {
+		audio = filtered
+	}
+
+	if s.meter.update(filtered) {
+		s.recorder.showLevel(ctx, &s.meter)
+	}
+
+	next := currentTuning()
+	if next.threshold != s.tuned.threshold {
+		if changed, err := newSilenceDetector(next.threshold); err == nil {
+			log.Printf("Silence threshold changed to %s", next.threshold)
+			s.detector = changed
+		}
+	}
+	s.tuned = next
+
+	cutoff := s.detector.effectiveThreshold()
+	silent := s.detector.isSilent(filtered)
+	if energyLog != nil {
+		energyLog.Record(chunk.timestamp, averageEnergy(filtered), cutoff, silent)
+	}
+
+	if silent {
+		return s.handleSilence(ctx, chunk.timestamp, audio)
+	}
+	s.handleSpeech(ctx, chunk.timestamp, audio)
+	return false
+}
+
+// handleSilence processes a silent chunk, ending the phrase, line or
+// sentence once the silence is long enough. It reports whether the session
+// is over.
+func (s *session) handleSilence(ctx context.Context, timestamp time.Time, audio []int16) bool {
+	if s.onsetChunks > 0 {
+		logEvent(slog.LevelDebug, fmt.Sprintf("Ignoring %d chunk(s) of sound too short to start a phrase", s.onsetChunks),
+			"chunks", s.onsetChunks)
+		s.onset, s.onsetChunks = s.onset[:0], 0
+	}
+
+	// The next chunk of speech starts a new phrase with no overlap
+	s.realtimeTail, s.realtimeWords = s.realtimeTail[:0], nil
+
+	if s.silenceStart.IsZero() {
+		s.silenceStart = timestamp
+		logEvent(slog.LevelDebug, fmt.Sprintf("Silence started at %v", s.silenceStart))
+	}
+	// Measured between chunk timestamps rather than against the clock,
+	// since -stdin input can arrive faster than real time.
+	silence := timestamp.Sub(s.silenceStart)
+
+	if *idleLimit > 0 && silence >= *idleLimit {
+		logEvent(slog.LevelInfo, fmt.Sprintf("No speech for %v, stopping recording", *idleLimit),
+			"silence_ms", silence.Milliseconds())
+		if *readStdin || *once {
+			return true
+		}
+		s.recorder.finished(ctx)
+		return false
+	}
+
+	if *manualEnd {
+		// Only a flush request ends the phrase; its pauses stay in it
+		if len(s.phraseBuffer) > 0 {
+			s.phraseBuffer = append(s.phraseBuffer, audio...)
+		}
+		return false
+	}
+
+	if len(s.phraseBuffer) > 0 && silence < s.tuned.pause {
+		// Breath pause: keep the gap so the phrase stays in one piece
+		s.phraseBuffer = append(s.phraseBuffer, audio...)
+		return false
+	}
+
+	if len(s.spooled) > 0 && !serverDown.Load() {
+		s.replaySpooled(ctx)
+	}
+
+	if len(s.phraseBuffer) > 0 {
+		// While phrases are spooled new ones join them, so the text
+		// stays in the order it was spoken.
+		var err error
+		if len(s.spooled) == 0 || !s.spool() {
+			err = s.flushPhrase(ctx, 0)
+		}
+		if err != nil && isUnreachable(err) && s.spool() {
+			s.recorder.setServerDown(err)
+			err = nil
+		}
+		if err != nil && ctx.Err() != nil {
+			// Stopped mid-request: finish transcribes the phrase
+			return false
+		}
+		if err != nil {
+			// Keep the buffered audio so it is retried at the next silence boundary.
+			logEvent(slog.LevelError, fmt.Sprintf("Transcription error, keeping buffered audio: %v", err),
+				"error", err, "phrase_ms", audioConfig.durationOf(len(s.phraseBuffer)).Milliseconds())
+			notifyError("Transcription failed", err)
+			s.silenceStart = time.Time{}
+			return false
+		}
+	}
+	if silence >= s.tuned.pause {
+		s.endLine()
+	}
+
+	// -once is done after the first phrase that typed something
+	if *once && s.typed != "" && silence >= s.tuned.pause {
+		return true
+	}
+
+	if !s.sentenceEnded && silence >= s.tuned.sentencePause {
+		ended := endSentence(s.typer, s.typed)
+		s.recorder.extendEdit(s.typed, ended)
+		s.typed = ended
+		s.sentenceEnded = true
+	}
+	return false
+}
+
+// handleSpeech processes a chunk of speech, adding it to the phrase once
+// enough consecutive chunks confirm a phrase is starting. Until then
+// silence timing isn't reset, so an isolated click is ignored entirely.
+func (s *session) handleSpeech(ctx context.Context, timestamp time.Time, audio []int16) {
+	if len(s.phraseBuffer) == 0 && len(s.realtimeTail) == 0 {
+		s.onset = append(s.onset, audio...)
+		s.onsetChunks++
+		if s.onsetChunks < *minSpeech {
+			return
+		}
+		audio = s.onset
+		s.onset, s.onsetChunks = nil, 0
+	}
+
+	if !s.silenceStart.IsZero() {
+		gap := timestamp.Sub(s.silenceStart)
+		logEvent(slog.LevelDebug, fmt.Sprintf("Speech detected after %v of silence", gap),
+			"silence_ms", gap.Milliseconds())
+	}
+	s.silenceStart = time.Time{}
+	s.sentenceEnded = false
+
+	if *realtime {
+		if err := s.typeChunk(ctx, audio); err != nil && ctx.Err() == nil {
+			logEvent(slog.LevelError, fmt.Sprintf("Transcription error: %v", err), "error", err)
+			notifyError("Transcription failed", err)
+		}
+		return
+	}
+
+	if len(s.phraseBuffer) == 0 {
+		s.phraseStart = s.sessionSamples - len(audio) - len(s.contextTail)
+		s.phraseBuffer = append(s.phraseBuffer, s.contextTail...)
+		s.contextTail = s.contextTail[:0]
+	}
+	s.phraseBuffer = append(s.phraseBuffer, audio...)
+
+	if len(s.phraseBuffer) >= s.maxPhraseSamples && !*manualEnd {
+		logEvent(slog.LevelInfo, fmt.Sprintf("Phrase reached %v without a pause, forcing transcription", *maxPhrase),
+			"phrase_ms", audioConfig.durationOf(len(s.phraseBuffer)).Milliseconds())
+		if err := s.flushPhrase(ctx, s.overlapSamples); err != nil && ctx.Err() == nil {
+			logEvent(slog.LevelError, fmt.Sprintf("Transcription error, keeping buffered audio: %v", err),
+				"error", err, "phrase_ms", audioConfig.durationOf(len(s.phraseBuffer)).Milliseconds())
+			notifyError("Transcription failed", err)
+		}
+		return
+	}
+
+	if *streaming {
+		s.chunksSinceInterim++
+		// With every request slot busy the interim is skipped; the next
+		// one covers this audio too.
+		if s.chunksSinceInterim >= *streamStep && s.interimPending < *maxReqs {
+			s.chunksSinceInterim = 0
+			s.interimSeq++
+			s.interimPending++
+			if s.cancelInterims == nil {
+				s.interimCtx, s.cancelInterims = context.WithCancel(ctx)
+			}
+			// The capped slice keeps later appends from touching the
+			// samples being sent
+			go func(ctx context.Context, seq, phrase int, samples []int16) {
+				text, err := s.transcriber.Transcribe(ctx, samples)
+				s.interimResults <- interimResult{seq: seq, phrase: phrase, text: text, err: err}
+			}(s.interimCtx, s.interimSeq, s.phraseCount, s.phraseBuffer[:len(s.phraseBuffer):len(s.phraseBuffer)])
+		}
+	}
+}
+
+// dropCarried removes words repeated from the audio carried over from the
+// previous phrase from the start of text.
+func (s *session) dropCarried(text string) string {
+	if s.carriedWords == nil {
+		return text
+	}
+	return trimRepeated(s.carriedWords, text)
+}
+
+// flushPhrase transcribes and outputs phraseBuffer, keeping its last tail
+// samples as the start of the next phrase so words at a forced boundary
+// aren't cut. Words repeated from the carried tail are dropped. With
+// -phrase-context a phrase ending at a pause also keeps its last
+// chunkOverlap of audio, which is prepended once the next phrase starts.
+func (s *session) flushPhrase(ctx context.Context, tail int) error {
+	// Any interim is superseded by this transcription, which would
+	// otherwise queue behind them with -max-requests
+	if s.cancelInterims != nil {
+		s.cancelInterims()
+		s.interimCtx, s.cancelInterims = nil, nil
+	}
+	result, err := transcribePhrase(ctx, s.transcriber, s.phraseBuffer, audioConfig)
+	if err != nil {
+		return err
+	}
+	selectProfile(s.recorder.typer)
+	s.subtitles.Add(audioConfig.durationOf(s.phraseStart), result.Segments)
+	text := s.dropCarried(result.Text)
+	s.carriedWords = nil
+
+	s.transcriptLines = append(s.transcriptLines, text)
+	recordTranscript(text)
+	s.recorder.addPhrase(text)
+
+	before := s.typed
+	s.typed = commitPhrase(s.typer, s.typed, s.interim, text)
+	s.recorder.recordEdit(before, s.typed)
+	s.interim = ""
+	s.chunksSinceInterim = 0
+	s.phraseCount++
+
+	if tail > 0 && tail < len(s.phraseBuffer) {
+		s.phraseBuffer = append([]int16(nil), s.phraseBuffer[len(s.phraseBuffer)-tail:]...)
+		s.phraseStart = s.sessionSamples - tail
+		s.carriedWords = strings.Fields(text)
+	} else {
+		if *phraseCtx && text != "" {
+			s.contextTail = append(s.contextTail[:0], s.phraseBuffer[max(len(s.phraseBuffer)-s.overlapSamples, 0):]...)
+			s.carriedWords = strings.Fields(text)
+		}
+		s.phraseBuffer = nil
+	}
+	return nil
+}
+
+// typeChunk transcribes a chunk of speech on its own in -realtime mode and
+// types the words that weren't already typed for the previous one.
+func (s *session) typeChunk(ctx context.Context, data []int16) error {
+	samples := append(append([]int16(nil), s.realtimeTail...), data...)
+	text, err := s.transcriber.Transcribe(ctx, samples)
+	if err != nil {
+		return err
+	}
+	s.realtimeTail = append(s.realtimeTail[:0], data[max(len(data)-s.overlapSamples, 0):]...)
+
+	words := strings.Fields(text)
+	merged := mergeOverlap(append([]string(nil), s.realtimeWords...), words)
+	text = strings.Join(merged[len(s.realtimeWords):], " ")
+	s.realtimeWords = words
+	if text == "" {
+		return nil
+	}
+
+	s.transcriptLines = append(s.transcriptLines, text)
+	recordTranscript(text)
+	s.recorder.addPhrase(text)
+	selectProfile(s.recorder.typer)
+
+	before := s.typed
+	s.typed = commitPhrase(s.typer, s.typed, "", text)
+	s.recorder.recordEdit(before, s.typed)
+	return nil
+}
+
+// spool saves phraseBuffer to -spool-dir rather than keeping it while the
+// server is unreachable. It reports whether it did.
+func (s *session) spool() bool {
+	if *spoolDir == "" {
+		return false
+	}
+	path, err := spoolPhrase(s.phraseBuffer, audioConfig)
+	if err != nil {
+		log.Printf("Failed to spool phrase: %v", err)
+		return false
+	}
+	log.Printf("Saved phrase to %s until the server is reachable", path)
+	s.spooled = append(s.spooled, path)
+	s.phraseBuffer, s.carriedWords = nil, nil
+	return true
+}
+
+// replaySpooled transcribes and types the spooled phrases in order. A
+// failure marks the server down, so the rest wait for the next health
+// check that finds it up.
+func (s *session) replaySpooled(ctx context.Context) {
+	for len(s.spooled) > 0 {
+		path := s.spooled[0]
+		samples, _, err := readWavFile(path)
+		if err != nil {
+			log.Printf("Dropping spooled phrase: %v", err)
+			s.spooled = s.spooled[1:]
+			continue
+		}
+		result, err := transcribePhrase(ctx, s.transcriber, samples, audioConfig)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.recorder.setServerDown(err)
+			}
+			return
+		}
+		s.spooled = s.spooled[1:]
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove spooled phrase: %v", err)
+		}
+
+		selectProfile(s.recorder.typer)
+		s.transcriptLines = append(s.transcriptLines, result.Text)
+		recordTranscript(result.Text)
+		s.recorder.addPhrase(result.Text)
+		before := s.typed
+		s.typed = commitPhrase(s.typer, s.typed, "", result.Text)
+		s.recorder.recordEdit(before, s.typed)
+	}
+}
+
+// finish ends the session when it is stopped or -stdin input ends. The
+// session context may already be canceled, so its last requests get their
+// own, bounded like a shutdown.
+func (s *session) finish() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if len(s.spooled) > 0 && !serverDown.Load() {
+		s.replaySpooled(ctx)
+	}
+	if len(s.spooled) > 0 {
+		if len(s.phraseBuffer) > 0 {
+			s.spool()
+		}
+		log.Printf("%d phrase(s) are still saved in %s; transcribe them with -file", len(s.spooled), *spoolDir)
+	}
+	// The phrase in progress is typed like any other, over its interim
+	// guess if one is shown, and ends the line with the rest.
+	var finalErr error
+	if len(s.phraseBuffer) > 0 {
+		if err := s.flushPhrase(ctx, 0); err != nil {
+			finalErr = fmt.Errorf("final transcription error: %w", err)
+		}
+	}
+	s.endLine()
+	// Each session starts with empty typed text, so it gets no leading
+	// space; with -standalone it leaves no trailing one either.
+	if *standalone && strings.HasSuffix(s.typed, " ") {
+		if err := s.typer.PressKey("BackSpace"); err != nil {
+			log.Printf("Failed to remove trailing space: %v", err)
+		} else {
+			s.recorder.extendEdit(s.typed, strings.TrimSuffix(s.typed, " "))
+		}
+	}
+	if err := finalizeTranscript(s.transcriptLines, audioConfig, &s.subtitles); err != nil {
+		return err
+	}
+	return finalErr
+}
+
+// streamFinishTimeout bounds how long stopping a streaming session waits for
+// the final text of the phrase in progress.
+const streamFinishTimeout = 3 * time.Second
+
+// runStreaming is run for a StreamingTranscriber. Every captured chunk is
+// forwarded as it arrives, partial results are typed as interim text, and
+// final results commit it; the server decides where phrases end.
+func runStreaming(ctx context.Context, recorder *Recorder, stream StreamingTranscriber) error {
+	audioChan := recorder.capture(ctx)
+	filter := newAudioFilter(*highPass, audioConfig)
+
+	if keyboard, ok := recorder.typer.(interface{ ResetRemaps() }); ok {
+		defer keyboard.ResetRemaps()
+	}
+	typer := newTypingQueue(recorder.typer)
+	defer typer.Close()
+
+	var (
+		typed           string
+		interim         string
+		transcriptLines []string
+		meter           levelMeter
+		unfinished      bool // Whether audio was sent since the last final result
+	)
+	handle := func(result StreamResult) {
+		selectProfile(recorder.typer)
+		if !result.Final {
+			formatted := formatTranscript(typed, result.Text)
+			interim = reconcileText(typer, interim, formatted+trailingSpace(formatted))
+			return
+		}
+		unfinished = false
+
+		text := strings.TrimSpace(result.Text)
+		if text == "" || isHallucination(text) {
+			interim = reconcileText(typer, interim, "")
+			return
+		}
+		transcriptLines = append(transcriptLines, text)
+		recordTranscript(text)
+		recorder.addPhrase(text)
+		before := typed
+		typed = commitPhrase(typer, typed, interim, text)
+		recorder.recordEdit(before, typed)
+		interim = ""
+
+		// A final result ends the phrase
+		ended := endLine(typer, typed)
+		recorder.extendEdit(typed, ended)
+		typed = ended
+	}
+
+	// The results channel outlives sessions; anything left in it belongs
+	// to an earlier one, such as a final that came after it timed out.
+	results := stream.Results()
+	drainResults(results)
+	finish := func() error {
+		if unfinished {
+			if err := stream.Finish(); err != nil {
+				logEvent(slog.LevelError, fmt.Sprintf("Final transcription error: %v", err), "error", err)
+			} else {
+				waitForFinal(results, handle)
+			}
+		}
+		if *standalone && strings.HasSuffix(typed, " ") {
+			if err := typer.PressKey("BackSpace"); err != nil {
+				log.Printf("Failed to remove trailing space: %v", err)
+			} else {
+				recorder.extendEdit(typed, strings.TrimSuffix(typed, " "))
+			}
+		}
+		return finalizeTranscript(transcriptLines, audioConfig, &SubtitleTrack{})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return finish()
+
+		case chunk, ok := <-audioChan:
+			if !ok {
+				if ctx.Err() != nil {
+					audioChan = nil
+					continue
+				}
+				if *readStdin {
+					return finish()
+				}
+				return fmt.Errorf("audio capture stopped")
+			}
+			if recorder.Paused() {
+				releaseSamples(chunk.data)
+				continue
+			}
+			stats.recordChunk()
+			filtered := filter.apply(chunk.data)
+			if meter.update(filtered) {
+				recorder.showLevel(ctx, &meter)
+			}
+			audio := chunk.data
+			if *filterAud {
+				audio = filtered
+			}
+			err := stream.Send(audio)
+			releaseSamples(chunk.data)
+			if err != nil {
+				logEvent(slog.LevelError, fmt.Sprintf("Streaming error: %v", err), "error", err)
+				notifyError("Streaming failed", err)
+			} else {
+				unfinished = true
+			}
+
+		case result := <-results:
+			handle(result)
+			if *once && typed != "" {
+				return finish()
+			}
+
+		case <-recorder.undoRequests:
+			if interim == "" {
+				typed = recorder.undo(typer, typed)
+			}
+		}
+	}
+}
+
+// drainResults discards the results waiting in results.
+func drainResults(results <-chan StreamResult) {
+	for {
+		select {
+		case result := <-results:
+			debugf("Discarding streaming result %q from an earlier session", result.Text)
+		default:
+			return
+		}
+	}
+}
+
+// waitForFinal passes results to handle until a final one arrives or
+// streamFinishTimeout elapses.
+func waitForFinal(results <-chan StreamResult, handle func(StreamResult)) {
+	timeout := time.After(streamFinishTimeout)
+	for {
+		select {
+		case result := <-results:
+			handle(result)
+			if result.Final {
+				return
+			}
+		case <-timeout:
+			log.Printf("Timed out waiting for the final transcription")
+			return
+		}
+	}
+}
+
+// commitPhrase outputs text, a completed phrase, correcting interim, the
+// partial text already typed for it. Commands replace the interim text
+// entirely. It returns the updated typed text.
+func commitPhrase(typer TextTyper, typed, interim, text string) string {
+	if interim != "" && !isCommand(text) {
+		formatted := formatTranscript(typed, text)
+		formatted += trailingSpace(formatted)
+		reconcileText(typer, interim, formatted)
+		return typed + formatted
+	}
+	reconcileText(typer, interim, "")
+	return outputPhrase(typer, typed, text)
+}
+
+// reconcileText edits shown, the text currently on screen, into target by
+// backspacing over everything after their common prefix and typing the rest.
+// It returns target.
+func reconcileText(typer TextTyper, shown, target string) string {
+	shownRunes, targetRunes := []rune(shown), []rune(target)
+	common := 0
+	for common < len(shownRunes) && common < len(targetRunes) && shownRunes[common] == targetRunes[common] {
+		common++
+	}
+
+	for i := common; i < len(shownRunes); i++ {
+		if err := typer.PressKey("BackSpace"); err != nil {
+			log.Printf("Failed to erase interim text: %v", err)
+			break
+		}
+	}
+	if common < len(targetRunes) {
+		typer.TypeText(string(targetRunes[common:]))
+	}
+	return target
+}
+
+// readNextChunk returns the next chunk if one is ready. closed reports that
+// recordLoop has stopped and no more chunks will arrive on audioChan.
+func readNextChunk(audioChan chan AudioChunk) (chunk AudioChunk, ok, closed bool) {
+	select {
+	case chunk, open := <-audioChan:
+		return chunk, open, !open
+	default:
+		return AudioChunk{}, false, false
+	}
+}
+
+// energyDumpQueue is how many chunk records EnergyDump holds for its writer
+// before dropping new ones.
+const energyDumpQueue = 256
+
+// EnergyDump appends a CSV row per chunk with its energy and how silence
+// detection judged it. Rows are written by a separate goroutine, so a slow
+// disk can't hold up the audio loop; rows that don't fit the queue are
+// dropped and counted instead.
+type EnergyDump struct {
+	rows    chan string
+	done    chan struct{} // Closed once the writer has flushed and exited
+	dropped atomic.Int64
+
+	// mu guards closed, so a session still running at exit can't send on
+	// the closed rows channel.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func openEnergyDump(path string) (*EnergyDump, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening energy dump: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening energy dump: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	if info.Size() == 0 {
+		writer.WriteString("time,energy,threshold,silent\n")
+	}
+	d := &EnergyDump{rows: make(chan string, energyDumpQueue), done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		defer file.Close()
+		failed := false
+		for row := range d.rows {
+			writer.WriteString(row)
+			// Flush once caught up, so the file stays current for plotting
+			if len(d.rows) > 0 {
+				continue
+			}
+			if err := writer.Flush(); err != nil && !failed {
+				log.Printf("Failed to write energy dump: %v", err)
+				failed = true
+			}
+		}
+	}()
+	return d, nil
+}
+
+// Close writes the queued rows and closes the file. Rows recorded after it
+// is called are ignored.
+func (d *EnergyDump) Close() {
+	d.mu.Lock()
+	d.closed = true
+	close(d.rows)
+	d.mu.Unlock()
+	<-d.done
+	if dropped := d.dropped.Load(); dropped > 0 {
+		log.Printf("Energy dump dropped %d rows", dropped)
+	}
+}
+
+// Record queues a row for a chunk captured at timestamp, without waiting.
+func (d *EnergyDump) Record(timestamp time.Time, energy int64, threshold float64, silent bool) {
+	row := fmt.Sprintf("%s,%d,%.1f,%t\n", timestamp.Format("2006-01-02T15:04:05.000Z07:00"), energy, threshold, silent)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.rows <- row:
+	default:
+		if d.dropped.Add(1) == 1 {
+			log.Printf("Energy dump can't keep up; dropping rows")
+		}
+	}
+}
+
+// recordTranscript appends a non-empty phrase to the transcript log, if enabled.
+func recordTranscript(text string) {
+	if transcriptLog == nil || text == "" {
+		return
+	}
+	if err := transcriptLog.Append(text); err != nil {
+		log.Printf("Failed to log transcript: %v", err)
+	}
+}
+
+// finalizeTranscript prints the session's transcribed phrases and writes
+// its -stats and -save-srt output.
+func finalizeTranscript(lines []string, config AudioConfig, subtitles *SubtitleTrack) error {
+	fmt.Println("\nComplete Transcript:")
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	if *showStats {
+		log.Printf("Stats: %s", stats.Summary(config))
+	}
+
+	if *saveSRT != "" {
+		if err := subtitles.WriteSRT(*saveSRT); err != nil {
+			return err
+		}
+		log.Printf("Saved subtitles to %s", *saveSRT)
+	}
+	return nil
+}
+
+// resolveCaptureBackend maps the -capture flag value to a concrete command name.
+// "auto" picks the first backend found on PATH.
+func resolveCaptureBackend(name string) (string, error) {
+	if name != "auto" {
+		for _, backend := range captureBackends {
+			if name == backend {
+				return backend, nil
+			}
+		}
+		return "", fmt.Errorf("unknown capture backend %q", name)
+	}
+
+	for _, backend := range captureBackends {
+		if _, err := exec.LookPath(backend); err == nil {
+			return backend, nil
+		}
+	}
+	return "", fmt.Errorf("no capture backend found (tried %s)", strings.Join(captureBackends, ", "))
+}
+
+// captureCommand builds a command that writes raw s16le audio in the given
+// format to stdout, recording from the -device source when one is set.
+func captureCommand(ctx context.Context, backend string, config AudioConfig) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, backend, captureArgs(backend, config)...)
+
+	// Ask the recorder to exit cleanly when ctx is done, killing it only if
+	// it doesn't within WaitDelay.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 2 * time.Second
+	return cmd
+}
+
+// samplePool recycles chunk sample buffers from recordLoop. A buffer is
+// only returned once run no longer references it.
+var samplePool sync.Pool
+
+// getSamples returns a sample slice of length n, reusing a pooled buffer
+// when one is large enough.
+func getSamples(n int) []int16 {
+	if pooled, ok := samplePool.Get().(*[]int16); ok && cap(*pooled) >= n {
+		return (*pooled)[:n]
+	}
+	return make([]int16, n)
+}
+
+// releaseSamples returns samples to the pool. The caller must not use it
+// afterwards.
+func releaseSamples(samples []int16) {
+	samplePool.Put(&samples)
+}
+
+// recordLoop runs the capture command (parec or pw-record) to obtain raw audio.
+// It reads fixed-size chunks corresponding to chunkDuration and sends them on audioChan.
+func recordLoop(ctx context.Context, config AudioConfig, chunkDuration time.Duration, audioChan chan<- AudioChunk) {
+	chunkBytes := config.chunkBytes(chunkDuration)
+
+	backend, err := resolveCaptureBackend(*capture)
+	if err != nil {
+		logEvent(slog.LevelError, fmt.Sprintf("Failed to select capture backend: %v", err), "error", err)
+		close(audioChan)
+		return
+	}
+	logEvent(slog.LevelInfo, "Using capture backend: "+backend, "backend", backend,
+		"chunk_bytes", chunkBytes)
+
+	// Start the capture command.
+	cmd := captureCommand(ctx, backend, config)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logEvent(slog.LevelError, fmt.Sprintf("Failed to get %s stdout: %v", backend, err), "backend", backend, "error", err)
+		close(audioChan)
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		logEvent(slog.LevelError, fmt.Sprintf("Failed to get %s stderr: %v", backend, err), "backend", backend, "error", err)
+		close(audioChan)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		logEvent(slog.LevelError, fmt.Sprintf("Failed to start %s: %v", backend, err), "backend", backend, "error", err)
+		close(audioChan)
+		return
+	}
+
+	// Log stderr as it arrives so problems like an invalid device are visible.
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logEvent(slog.LevelWarn, fmt.Sprintf("%s: %s", backend, scanner.Text()), "backend", backend)
+		}
+	}()
+
+	// Exit when context is canceled or an error occurs.
+	readChunks(stdout, chunkBytes, audioChan, func(int) time.Time { return time.Now() })
+
+	<-stderrDone
+	waitErr := cmd.Wait()
+	switch {
+	case ctx.Err() != nil:
+		logEvent(slog.LevelInfo, fmt.Sprintf("%s stopped: %v", backend, ctx.Err()), "backend", backend)
+	case waitErr != nil:
+		logEvent(slog.LevelError, fmt.Sprintf("%s exited unexpectedly: %v", backend, waitErr), "backend", backend, "error", waitErr)
+	default:
+		logEvent(slog.LevelError, fmt.Sprintf("%s exited unexpectedly with no error", backend), "backend", backend)
+	}
+	close(audioChan)
+}
+
+// audioSource sends captured audio to audioChan until ctx is canceled or
+// the audio ends, then closes audioChan. Chunks are pooled samples that run
+// releases.
+type audioSource func(ctx context.Context, audioChan chan<- AudioChunk)
+
+// capture starts the recorder's audio source for a session.
+func (r *Recorder) capture(ctx context.Context) chan AudioChunk {
+	source := r.source
+	if source == nil {
+		source = func(ctx context.Context, audioChan chan<- AudioChunk) {
+			recordLoop(ctx, audioConfig, *chunkLen, audioChan)
+		}
+	}
+	audioChan := make(chan AudioChunk, 10)
+	go source(ctx, audioChan)
+	return audioChan
+}
+
+// readStdinAudio is the -stdin audioSource. Chunks are stamped by their
+// position in the input rather than when they were read, so pauses are
+// measured in audio time.
+func readStdinAudio(ctx context.Context, audioChan chan<- AudioChunk) {
+	start := time.Now()
+	var read int
+	readChunks(os.Stdin, audioConfig.chunkBytes(*chunkLen), audioChan, func(samples int) time.Time {
+		read += samples
+		return start.Add(audioConfig.durationOf(read))
+	})
+	log.Printf("End of input on stdin")
+	close(audioChan)
+}
+
+// readChunks reads chunkBytes of PCM at a time from r and sends it to
+// audioChan, timestamped by stamp with the chunk's sample count, until r
+// ends or fails. A partial chunk at the end is dropped.
+func readChunks(r io.Reader, chunkBytes int, audioChan chan<- AudioChunk, stamp func(samples int) time.Time) {
+	buffer := make([]byte, chunkBytes)
+	for {
+		if _, err := io.ReadFull(r, buffer); err != nil {
+			return
+		}
+
+		// Convert straight out of the read buffer, which is reused, into a
+		// pooled slice that run releases once it is done with the chunk.
+		samples := getSamples(len(buffer) / 2)
+		for i := range samples {
+			samples[i] = int16(binary.LittleEndian.Uint16(buffer[i*2:]))
+		}
+
+		audioChan <- AudioChunk{
+			timestamp: stamp(len(samples)),
+			data:      samples,
+		}
+	}
+}
+
+// silenceDetector classifies chunks as silent using either a static energy
+// threshold or, in adaptive mode, a multiple of a rolling noise-floor estimate.
+type silenceDetector struct {
+	adaptive   bool
+	threshold  int
+	calibrated bool
+	noiseFloor float64
+}
+
+// validateThreshold returns an error unless spec, a -threshold value, is
+// auto or a number from 0 to maxThreshold.
+func validateThreshold(spec string) error {
+	if spec == "auto" {
+		return nil
+	}
+	value, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("%q must be a number or auto", spec)
+	}
+	if value < 0 || value > maxThreshold {
+		return fmt.Errorf("%d must be between 0 and %d", value, maxThreshold)
+	}
+	return nil
+}
+
+// newSilenceDetector parses the -threshold flag value: "auto" enables the
+// adaptive noise floor, a number sets a static threshold.
+func newSilenceDetector(spec string) (*silenceDetector, error) {
+	if spec == "auto" {
+		return &silenceDetector{adaptive: true}, nil
+	}
+	threshold, err := strconv.Atoi(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold %q: must be a number or auto", spec)
+	}
+	return &silenceDetector{threshold: threshold}, nil
+}
+
+// effectiveThreshold returns the energy threshold the next chunk is judged
+// by, which in adaptive mode is 0 until the noise floor is calibrated.
+func (d *silenceDetector) effectiveThreshold() float64 {
+	if d.adaptive {
+		return d.noiseFloor * noiseFloorRatio
+	}
+	return float64(d.threshold)
+}
+
+// isSilent reports whether the chunk contains no voice activity at the
+// effective energy threshold. In adaptive mode the first chunk seeds the noise
+// floor, and every silent chunk after that updates its moving average.
+func (d *silenceDetector) isSilent(data []int16) bool {
+	// An empty chunk carries no speech, and must not calibrate the noise
+	// floor to zero.
+	if len(data) == 0 {
+		return true
+	}
+
+	params := vadParams{
+		energyThreshold: float64(d.threshold),
+		zcrThreshold:    *zcrLimit,
+	}
+	if !d.adaptive {
+		return !detectVoiceActivity(data, params)
+	}
+
+	energy := float64(averageEnergy(data))
+	if !d.calibrated {
+		d.calibrated = true
+		d.noiseFloor = energy
+		logEvent(slog.LevelInfo, fmt.Sprintf("Calibrated noise floor: %.1f", d.noiseFloor), "noise_floor", d.noiseFloor)
+		return true
+	}
+
+	params.energyThreshold = d.noiseFloor * noiseFloorRatio
+	if detectVoiceActivity(data, params) {
+		return false
+	}
+	d.noiseFloor += noiseFloorAlpha * (energy - d.noiseFloor)
+	return true
+}
+
+// calibrationTime is how much room noise -calibrate records, and
+// calibrationStep how far apart the chunk-length windows it measures start,
+// so even a few seconds give enough of them for a percentile.
+const (
+	calibrationTime = 5 * time.Second
+	calibrationStep = 100 * time.Millisecond
+)
+
+// calibrateThreshold records room noise for -calibrate and prints the
+// energy threshold to use: the 95th percentile of the noise's energy, as
+// isSilent averages it over each chunk, with the margin adaptive mode
+// keeps above its noise floor. With -calibrate-save the threshold is also
+// written to the config file.
+func calibrateThreshold() error {
+	duration := max(calibrationTime, 3**chunkLen)
+	ctx, cancel := context.WithTimeout(context.Background(), duration+5*time.Second)
+	defer cancel()
+
+	audioChan := make(chan AudioChunk, 10)
+	if *readStdin {
+		go readStdinAudio(ctx, audioChan)
+	} else {
+		go recordLoop(ctx, audioConfig, calibrationStep, audioChan)
+	}
+	fmt.Printf("Recording %v of room noise, keep quiet...\n", duration)
+
+	want := audioConfig.samplesIn(duration)
+	var samples []int16
+	for len(samples) < want {
+		chunk, ok := <-audioChan
+		if !ok {
+			break
+		}
+		samples = append(samples, chunk.data...)
+		releaseSamples(chunk.data)
+	}
+	cancel()
+
+	window := audioConfig.samplesIn(*chunkLen)
+	step := audioConfig.samplesIn(calibrationStep)
+	if len(samples) < window {
+		return fmt.Errorf("calibration recorded %v of audio, need at least %v",
+			audioConfig.durationOf(len(samples)), *chunkLen)
+	}
+	var energies []float64
+	for start := 0; start+window <= len(samples); start += step {
+		energies = append(energies, float64(averageEnergy(samples[start:start+window])))
+	}
+	slices.Sort(energies)
+	median := energies[len(energies)/2]
+	noise := energies[len(energies)*95/100]
+	threshold := min(max(int(math.Ceil(noise*noiseFloorRatio)), 1), maxThreshold)
+
+	// Hiss can still count as speech by its zero-crossing rate, whose dead
+	// band is the threshold, so raise it until most of the noise is silent.
+	speechShare := func(threshold int) float64 {
+		params := vadParams{energyThreshold: float64(threshold), zcrThreshold: *zcrLimit}
+		var speech int
+		for start := 0; start+window <= len(samples); start += step {
+			if detectVoiceActivity(samples[start:start+window], params) {
+				speech++
+			}
+		}
+		return float64(speech) / float64(len(energies))
+	}
+	for threshold < maxThreshold && speechShare(threshold) > 0.05 {
+		threshold = min(threshold+max(threshold/10, 1), maxThreshold)
+	}
+
+	fmt.Printf("Noise energy: median %.0f, 95th percentile %.0f\n", median, noise)
+	fmt.Printf("Recommended -threshold: %d\n", threshold)
+
+	if !*calSave {
+		return nil
+	}
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := saveConfigOption(path, "threshold", strconv.Itoa(threshold)); err != nil {
+		return err
+	}
+	fmt.Printf("Saved -threshold %d to %s\n", threshold, path)
+	return nil
+}
+
+// saveConfigOption sets one option in the config file at path, keeping the
+// others.
+func saveConfigOption(path, name string, value any) error {
+	values := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding option %q: %w", name, err)
+	}
+	values[name] = encoded
+	data, err = json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating config directory: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	return nil
+}
+
+// vadParams tunes detectVoiceActivity.
+type vadParams struct {
+	// energyThreshold is the average absolute amplitude at or above which a
+	// chunk counts as speech. It also sets the dead band for zero crossings.
+	energyThreshold float64
+	// zcrThreshold is the zero-crossing rate (crossings per sample) at or
+	// above which a chunk counts as speech, catching quiet consonants.
+	zcrThreshold float64
+}
+
+// detectVoiceActivity reports whether the chunk contains speech. A chunk is
+// silent only when both its short-term energy and zero-crossing rate fall
+// below their thresholds. Crossings are only counted when the signal swings
+// past the energy threshold on both sides, so low-level hiss does not count.
+func detectVoiceActivity(data []int16, params vadParams) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	energy := float64(averageEnergy(data))
+	zcr := zeroCrossingRate(data, params.energyThreshold)
+	if *debug {
+		logEvent(slog.LevelDebug, fmt.Sprintf("Computed average energy: %.0f, zero-crossing rate: %.3f", energy, zcr),
+			"energy", energy, "zcr", zcr, "threshold", params.energyThreshold)
+	}
+
+	return energy >= params.energyThreshold || zcr >= params.zcrThreshold
+}
+
+// zeroCrossingRate returns the fraction of samples at which the signal crosses
+// zero, ignoring excursions that stay within ±deadband.
+func zeroCrossingRate(data []int16, deadband float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var crossings, sign int
+	for _, sample := range data {
+		switch {
+		case float64(sample) > deadband:
+			if sign < 0 {
+				crossings++
+			}
+			sign = 1
+		case float64(sample) < -deadband:
+			if sign > 0 {
+				crossings++
+			}
+			sign = -1
+		}
+	}
+	return float64(crossings) / float64(len(data))
+}
+
+// levelMeter smooths chunk energies into the input level shown in the tray
+// tooltip, to tell a dead microphone from a server problem.
+type levelMeter struct {
+	level   float64
+	updated time.Time
+}
+
+// update folds the chunk's energy into the smoothed level and reports whether
+// levelInterval has passed since the level was last shown.
+func (m *levelMeter) update(data []int16) bool {
+	m.level += levelAlpha * (float64(averageEnergy(data)) - m.level)
+	if time.Since(m.updated) < levelInterval {
+		return false
+	}
+	m.updated = time.Now()
+	return true
+}
+
+// String renders the level as a bar on a decibel scale from levelFloorDB to
+// full scale, e.g. "[######----]".
+func (m *levelMeter) String() string {
+	fraction := 0.0
+	if m.level > 0 {
+		db := 20 * math.Log10(m.level/math.MaxInt16)
+		fraction = min(max((db-levelFloorDB)/-levelFloorDB, 0), 1)
+	}
+	filled := int(math.Round(fraction * levelWidth))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", levelWidth-filled) + "]"
+}
+
+// audioFilter removes each channel's DC offset from captured chunks and,
+// when given a cutoff, low-frequency rumble with a one-pole high-pass
+// filter. A biased input would otherwise inflate averageEnergy so that no
+// chunk ever counts as silent.
+type audioFilter struct {
+	channels int
+	alpha    float64 // High-pass coefficient, 0 when disabled
+
+	// High-pass state per channel, carried across chunks
+	prevIn  []float64
+	prevOut []float64
+
+	out []int16
+}
+
+func newAudioFilter(cutoff float64, config AudioConfig) *audioFilter {
+	f := &audioFilter{
+		channels: config.Channels,
+		prevIn:   make([]float64, config.Channels),
+		prevOut:  make([]float64, config.Channels),
+	}
+	if cutoff > 0 {
+		rc := 1 / (2 * math.Pi * cutoff)
+		dt := 1 / float64(config.SampleRate)
+		f.alpha = rc / (rc + dt)
+	}
+	return f
+}
+
+// apply returns the filtered chunk. The result is reused by the next call.
+func (f *audioFilter) apply(data []int16) []int16 {
+	f.out = slices.Grow(f.out[:0], len(data))[:len(data)]
+
+	for channel := 0; channel < f.channels; channel++ {
+		var sum, count float64
+		for i := channel; i < len(data); i += f.channels {
+			sum += float64(data[i])
+			count++
+		}
+		if count == 0 {
+			continue
+		}
+		mean := sum / count
+
+		for i := channel; i < len(data); i += f.channels {
+			value := float64(data[i]) - mean
+			if f.alpha > 0 {
+				in := value
+				value = f.alpha * (f.prevOut[channel] + in - f.prevIn[channel])
+				f.prevIn[channel], f.prevOut[channel] = in, value
+			}
+			f.out[i] = int16(max(min(math.Round(value), math.MaxInt16), math.MinInt16))
+		}
+	}
+	return f.out
+}
+
+// averageEnergy computes the average absolute amplitude of the samples.
+func averageEnergy(data []int16) int64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var sum int64
+	for _, sample := range data {
+		// Widen before negating: -(-32768) overflows int16
+		value := int64(sample)
+		if value < 0 {
+			value = -value
+		}
+		sum += value
+	}
+	return sum / int64(len(data))
+}
+
+// Transcriber converts a clip of samples in the capture format to text.
+// Canceling ctx abandons the transcription.
+type Transcriber interface {
+	Transcribe(ctx context.Context, samples []int16) (string, error)
+}
+
+// StreamingTranscriber accepts audio as it is captured and reports text as
+// the server recognizes it, rather than once per phrase.
+type StreamingTranscriber interface {
+	Transcriber
+	// Send forwards captured samples.
+	Send(samples []int16) error
+	// Finish asks for the final text of the utterance in progress.
+	Finish() error
+	// Results delivers recognized text. A final result completes a phrase
+	// and replaces the partial results before it.
+	Results() <-chan StreamResult
+}
+
+// StreamResult is text recognized by a StreamingTranscriber.
+type StreamResult struct {
+	Text  string
+	Final bool
+}
+
+// Client is the default Transcriber, posting each clip to a whisper.cpp or
+// OpenAI-compatible HTTP endpoint. newClient fills it in from flags; tests
+// can point httpClient and url at an httptest server instead.
+type Client struct {
+	httpClient *http.Client
+	servers    []string     // Endpoints tried in order, from -servers or -url
+	preferred  atomic.Int32 // Index of the server that last answered
+	config     AudioConfig
+	api        string // whispercpp or openai
+	token      string
+	model      string
+	language   string
+	prompt     string
+	segments   bool     // Request verbose_json with timed segments
+	serverType string   // Response shape: auto, whisper or faster-whisper
+	encoding   string   // Upload format, a key of uploadFormats
+	encoder    []string // Command converting WAV to encoding, nil for wav
+
+	// Form field names for the audio and response format, for servers
+	// that don't use whisper.cpp's file and response_format
+	fileField   string
+	formatField string
+
+	// With language unset, the language the server detects is locked in
+	// and sent once langLock consecutive responses agree on it.
+	langLock int
+	langMu   sync.Mutex
+	detected string // Most recently detected language code
+	streak   int    // Consecutive responses that detected it
+	locked   string // Language sent for the rest of the session
+
+	requests chan struct{} // Semaphore of -max-requests slots, nil for no limit
+}
+
+// newClient returns a Client configured from the command-line flags and
+// the prompt built by buildPrompt.
+func newClient(config AudioConfig, prompt string) *Client {
+	return &Client{
+		httpClient:  httpClient,
+		servers:     transcriptionURLs(),
+		config:      config,
+		api:         *apiKind,
+		token:       *apiToken,
+		model:       *apiModel,
+		language:    *language,
+		prompt:      prompt,
+		segments:    *saveSRT != "",
+		serverType:  *serverType,
+		encoding:    *encoding,
+		encoder:     encoder,
+		fileField:   *fileField,
+		formatField: *fmtField,
+		langLock:    *langLock,
+		requests:    make(chan struct{}, *maxReqs),
+	}
+}
+
+// requestLanguage returns the language to send, if any, and whether the
+// response should report the detected one.
+func (c *Client) requestLanguage() (language string, detect bool) {
+	if c.language != "" {
+		return c.language, false
+	}
+	c.langMu.Lock()
+	defer c.langMu.Unlock()
+	return c.locked, c.locked == "" && c.langLock > 0
+}
+
+// observeLanguage counts a detected language towards locking it. Detections
+// the server isn't confident of break the streak.
+func (c *Client) observeLanguage(detected string, confidence *float64) {
+	code := languageCode(detected)
+	if confidence != nil && *confidence < minLanguageConfidence {
+		code = ""
+	}
+
+	c.langMu.Lock()
+	defer c.langMu.Unlock()
+	if c.locked != "" {
+		return
+	}
+	if code == "" || code != c.detected {
+		c.detected, c.streak = code, 0
+	}
+	if code == "" {
+		return
+	}
+	c.streak++
+	debugf("Detected language %s (%d/%d)", code, c.streak, c.langLock)
+	if c.streak >= c.langLock {
+		c.locked = code
+		logEvent(slog.LevelInfo, fmt.Sprintf("Locking language to %s for this session", code), "language", code)
+	}
+}
+
+// ResetLanguage forgets the detected language at the start of a session.
+func (c *Client) ResetLanguage() {
+	c.langMu.Lock()
+	defer c.langMu.Unlock()
+	c.detected, c.streak, c.locked = "", 0, ""
+}
+
+func (c *Client) Transcribe(ctx context.Context, samples []int16) (string, error) {
+	result, err := c.transcribe(ctx, samples)
+	return result.Text, err
+}
+
+// Segment is a timed piece of a transcription. Start and End are relative
+// to the start of the transcribed audio.
+type Segment struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// Uploads of at least uploadProgressSize bytes log their progress every
+// uploadProgressInterval, so a large phrase on a slow uplink isn't silent.
+const (
+	uploadProgressSize     = 512 << 10
+	uploadProgressInterval = 2 * time.Second
+)
+
+// progressReader counts the bytes read from an upload body and logs how far
+// the upload has got.
+type progressReader struct {
+	r      io.Reader
+	total  int
+	read   int
+	logged time.Time // When progress was last logged, or the upload started
+	shown  bool      // Whether any progress has been logged
+}
+
+// newUploadBody returns a reader over body that logs upload progress when
+// body is large enough to be worth it.
+func newUploadBody(body []byte) io.Reader {
+	if len(body) < uploadProgressSize {
+		return bytes.NewReader(body)
+	}
+	return &progressReader{r: bytes.NewReader(body), total: len(body), logged: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += n
+	done := n > 0 && p.read == p.total
+	// Completion is only worth logging after progress has been
+	if now := time.Now(); now.Sub(p.logged) >= uploadProgressInterval || done && p.shown {
+		logEvent(slog.LevelInfo, fmt.Sprintf("Uploaded %d of %d bytes (%d%%)", p.read, p.total, p.read*100/p.total),
+			"uploaded_bytes", p.read, "total_bytes", p.total)
+		p.logged, p.shown = now, true
+	}
+	return n, err
+}
+
+// Transcription is a transcribed clip. Segments are only filled in when
+// -save-srt requests verbose_json from the server.
+type Transcription struct {
+	Text     string
+	Segments []Segment
+}
+
+// transcribe sends samples to the transcription server and parses the
+// response, including timed segments when c.segments is set.
+func (c *Client) transcribe(ctx context.Context, samples []int16) (Transcription, error) {
+	if c.api == "openai" && c.token == "" {
+		return Transcription{}, fmt.Errorf("openai API requires a token (set -token or WHISPER_API_KEY)")
+	}
+
+	// Requests beyond -max-requests wait for one in flight to finish
+	if c.requests != nil {
+		select {
+		case c.requests <- struct{}{}:
+		case <-ctx.Done():
+			return Transcription{}, ctx.Err()
+		}
+		defer func() { <-c.requests }()
+	}
+
+	wavBuffer := wavBuffers.Get().(*bytes.Buffer)
+	wavBuffer.Reset()
+	defer wavBuffers.Put(wavBuffer)
+
+	// Gain only affects what is sent for transcription; silence detection
+	// works on the raw captured samples.
+	if *autoGain {
+		samples = normalizeGain(samples)
+	} else if *gain != 1 {
+		samples = applyGain(samples, *gain)
+	}
+
+	if err := writeWavToBuffer(wavBuffer, samples, c.config); err != nil {
+		return Transcription{}, fmt.Errorf("writing WAV buffer: %w", err)
+	}
+	audio := wavBuffer.Bytes()
+	if c.encoder != nil {
+		encoded, err := encodeAudio(c.encoder, audio)
+		if err != nil {
+			return Transcription{}, fmt.Errorf("encoding %s: %w", c.encoding, err)
+		}
+		debugf("Encoded %d bytes of WAV as %d bytes of %s", len(audio), len(encoded), c.encoding)
+		audio = encoded
+	}
+
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+
+	format := uploadFormats[c.encoding]
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, c.fileField, format.filename))
+	header.Set("Content-Type", format.contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return Transcription{}, fmt.Errorf("creating form file: %w", err)
+	}
+
+	if _, err := part.Write(audio); err != nil {
+		return Transcription{}, fmt.Errorf("copying buffer: %w", err)
+	}
+
+	// Only verbose responses report the detected language
+	language, detect := c.requestLanguage()
+	responseFormat := "json"
+	if c.segments || detect {
+		responseFormat = "verbose_json"
+	}
+	if err := writer.WriteField(c.formatField, responseFormat); err != nil {
+		return Transcription{}, fmt.Errorf("adding response format field: %w", err)
+	}
+	if language != "" {
+		if err := writer.WriteField("language", language); err != nil {
+			return Transcription{}, fmt.Errorf("adding language field: %w", err)
+		}
+	}
+	if c.prompt != "" {
+		if err := writer.WriteField("prompt", c.prompt); err != nil {
+			return Transcription{}, fmt.Errorf("adding prompt field: %w", err)
+		}
+	}
+	if c.api == "openai" {
+		if err := writer.WriteField("model", c.model); err != nil {
+			return Transcription{}, fmt.Errorf("adding model field: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return Transcription{}, fmt.Errorf("closing writer: %w", err)
+	}
+
+	body := b.Bytes()
+	timeout := requestTimeout(c.config, len(samples))
+	resp, err := c.post(ctx, body, writer.FormDataContentType(), timeout)
+	if err != nil {
+		return Transcription{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return Transcription{}, fmt.Errorf("bad status: %s, body: %s", resp.Status, string(bodyBytes))
+	}
+
+	var result transcriptionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Transcription{}, fmt.Errorf("decoding response: %w", err)
+	}
+	text, err := result.text(c.serverType)
+	if err != nil {
+		return Transcription{}, err
+	}
+	if detect {
+		c.observeLanguage(result.language())
+	}
+
+	stats.recordTranscription(len(samples))
+
+	// Clean up the text
+	text = strings.TrimSpace(text)
+	if isHallucination(text) {
+		log.Printf("Dropping filtered transcription: %s", text)
+		return Transcription{}, nil
+	}
+
+	transcription := Transcription{Text: text}
+	for _, segment := range result.Segments {
+		transcription.Segments = append(transcription.Segments, Segment{
+			Start: time.Duration(segment.Start * float64(time.Second)),
+			End:   time.Duration(segment.End * float64(time.Second)),
+			Text:  strings.TrimSpace(segment.text()),
+		})
+	}
+	return transcription, nil
+}
+
+// transcriptionResponse covers the JSON shapes returned by whisper.cpp,
+// OpenAI and faster-whisper servers. faster-whisper may leave out the
+// top-level text, and with word_timestamps its segments carry timed words.
+type transcriptionResponse struct {
+	Text     *string           `json:"text"`
+	Segments []responseSegment `json:"segments"`
+	Words    []responseWord    `json:"words"`
+
+	// Verbose responses report the detected language. whisper.cpp names it
+	// in detected_language as well as language; faster-whisper gives a code.
+	Language            string   `json:"language"`
+	DetectedLanguage    string   `json:"detected_language"`
+	LanguageProbability *float64 `json:"language_probability"`
+	DetectedProbability *float64 `json:"detected_language_probability"`
+}
+
+// language returns the detected language and, if the server reported it,
+// the probability of the detection.
+func (r transcriptionResponse) language() (string, *float64) {
+	language, probability := r.Language, r.LanguageProbability
+	if r.DetectedLanguage != "" {
+		language = r.DetectedLanguage
+	}
+	if r.DetectedProbability != nil {
+		probability = r.DetectedProbability
+	}
+	return language, probability
+}
+
+type responseSegment struct {
+	Start float64        `json:"start"`
+	End   float64        `json:"end"`
+	Text  string         `json:"text"`
+	Words []responseWord `json:"words"`
+}
+
+type responseWord struct {
+	Word string `json:"word"`
+}
+
+// text returns the transcribed text for the -server-type hint. "whisper"
+// requires the top-level text field and "faster-whisper" prefers joining the
+// segments or words; "auto" tries the text field first. A response with
+// none of them is an error rather than an empty transcription.
+func (r transcriptionResponse) text(serverType string) (string, error) {
+	if r.Text != nil && serverType != "faster-whisper" {
+		return *r.Text, nil
+	}
+	if serverType == "whisper" {
+		return "", fmt.Errorf("response has no text field (is -server-type right?)")
+	}
+
+	if r.Segments != nil {
+		var text strings.Builder
+		for _, segment := range r.Segments {
+			text.WriteString(segment.text())
+		}
+		return text.String(), nil
+	}
+	if r.Words != nil {
+		return joinWords(r.Words), nil
+	}
+	if r.Text != nil {
+		return *r.Text, nil
+	}
+	return "", fmt.Errorf("response has no text or segments (is -server-type right?)")
+}
+
+// text returns the segment's text, rebuilding it from its words when the
+// server only filled those in.
+func (s responseSegment) text() string {
+	if s.Text == "" && len(s.Words) > 0 {
+		return joinWords(s.Words)
+	}
+	return s.Text
+}
+
+// joinWords concatenates timed words. faster-whisper includes each word's
+// leading space, so they are joined as-is.
+func joinWords(words []responseWord) string {
+	var text strings.Builder
+	for _, word := range words {
+		text.WriteString(word.Word)
+	}
+	return text.String()
+}
+
+// hallucinationFilters match transcriptions Whisper produces for silence or
+// background noise. Matching text is dropped entirely.
+var hallucinationFilters = []*regexp.Regexp{
+	regexp.MustCompile(`^\[[^\]]*\]$`),                                      // [BLANK_AUDIO], [MUSIC PLAYING]
+	regexp.MustCompile(`^\([^)]*\)$`),                                       // (upbeat music)
+	regexp.MustCompile(`^\*[^*]*\*$`),                                       // *music*
+	regexp.MustCompile(`^♪[^♪]*♪$`),                                         // ♪ lyrics ♪
+	regexp.MustCompile(`(?i)^thanks? (you )?(so much )?for watching[.!]*$`), // Thanks for watching!
+	regexp.MustCompile(`(?i)^please subscribe[^.!]*[.!]*$`),                 // Please subscribe to my channel.
+}
+
+// buildPrompt returns text followed by the vocabulary in path, one term per
+// line, joined into a comma-separated list. Blank lines and lines starting
+// with # are ignored.
+func buildPrompt(text, path string) (string, error) {
+	if path == "" {
+		return text, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading prompt file: %w", err)
+	}
+
+	var terms []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		terms = append(terms, line)
 	}
-
-	if err := xtest.Init(X); err != nil {
-		X.Close()
-		return nil, fmt.Errorf("initializing XTEST: %w", err)
+	if len(terms) == 0 {
+		return text, nil
 	}
-
-	// Get keyboard mapping
-	keyboard := &KeyboardSimulator{conn: X}
-	if err := keyboard.initKeymap(); err != nil {
-		X.Close()
-		return nil, fmt.Errorf("initializing keymap: %w", err)
+	vocabulary := strings.Join(terms, ", ") + "."
+	if text == "" {
+		return vocabulary, nil
 	}
-
-	return keyboard, nil
+	return text + " " + vocabulary, nil
 }
 
-func (k *KeyboardSimulator) initKeymap() error {
-	// Query the server for the first keycode
-	setup := xproto.Setup(k.conn)
-	mapping, err := xproto.GetKeyboardMapping(k.conn,
-		setup.MinKeycode,
-		byte(setup.MaxKeycode-setup.MinKeycode+1)).Reply()
+// loadFilters replaces the default hallucination filters with the regular
+// expressions in path, one per line. Blank lines and lines starting with #
+// are ignored.
+func loadFilters(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("getting keyboard mapping: %w", err)
+		return fmt.Errorf("reading filter file: %w", err)
 	}
 
-	// Create keymap
-	k.keymap = make(map[rune]byte)
-	keysPerCode := int(mapping.KeysymsPerKeycode)
-
-	// Iterate through keycodes
-	for keycode := int(setup.MinKeycode); keycode <= int(setup.MaxKeycode); keycode++ {
-		for offset := 0; offset < keysPerCode; offset++ {
-			// Calculate index in the keysyms array
-			idx := (keycode-int(setup.MinKeycode))*keysPerCode + offset
-			if idx >= len(mapping.Keysyms) {
-				continue
-			}
-
-			keysym := mapping.Keysyms[idx]
-			if keysym == 0 {
-				continue
-			}
-
-			// Convert keysym to rune if it represents a character
-			if r := keysymToRune(keysym); r != 0 {
-				k.keymap[r] = byte(keycode)
-			}
+	var filters []*regexp.Regexp
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		filter, err := regexp.Compile(line)
+		if err != nil {
+			return fmt.Errorf("filter file line %d: %w", i+1, err)
+		}
+		filters = append(filters, filter)
 	}
-
+	hallucinationFilters = filters
 	return nil
 }
 
-func keysymToRune(keysym xproto.Keysym) rune {
-	// Common punctuation marks
-	punctuation := map[xproto.Keysym]rune{
-		0x003f: '?',  // Question mark
-		0x002e: '.',  // Period
-		0x002c: ',',  // Comma
-		0x0021: '!',  // Exclamation mark
-		0x0027: '\'', // Single quote
-		0x0022: '"',  // Double quote
-		0x0028: '(',  // Left parenthesis
-		0x0029: ')',  // Right parenthesis
-		0x002d: '-',  // Hyphen
-		0x005f: '_',  // Underscore
+// isHallucination reports whether text matches any hallucination filter.
+func isHallucination(text string) bool {
+	for _, filter := range hallucinationFilters {
+		if filter.MatchString(text) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Check punctuation map first
-	if r, ok := punctuation[keysym]; ok {
-		return r
+// applyGain returns a copy of samples multiplied by gain, clipped to the
+// int16 range.
+func applyGain(samples []int16, gain float64) []int16 {
+	out := make([]int16, len(samples))
+	for i, sample := range samples {
+		value := math.Round(float64(sample) * gain)
+		out[i] = int16(max(math.MinInt16, min(math.MaxInt16, value)))
 	}
+	return out
+}
 
-	// Basic ASCII conversion
-	if keysym < 0x100 {
-		return rune(keysym)
+// normalizeGain scales samples so their RMS reaches autoGainTargetRMS,
+// never amplifying by more than autoGainMax.
+func normalizeGain(samples []int16) []int16 {
+	if len(samples) == 0 {
+		return samples
 	}
 
-	// Unicode direct mapping
-	if keysym >= 0x1000000 {
-		return rune(keysym - 0x1000000)
+	var sumSquares float64
+	for _, sample := range samples {
+		sumSquares += float64(sample) * float64(sample)
 	}
-
-	// Common Latin-1 characters
-	if keysym >= 0x20 && keysym <= 0x7e {
-		return rune(keysym)
+	rms := math.Sqrt(sumSquares / float64(len(samples)))
+	if rms == 0 {
+		return samples
 	}
 
-	return 0
+	gain := min(autoGainTargetRMS/rms, autoGainMax)
+	debugf("Auto gain: RMS %.0f, applying %.2fx", rms, gain)
+	return applyGain(samples, gain)
 }
 
-func (k *KeyboardSimulator) typeText(text string) {
-	// Type the transcribed text
-	for _, char := range text {
-		keycode, ok := k.keymap[char]
-		if !ok {
-			log.Printf("Skipping unknown character: %c (keycode not found)", char)
-			continue
-		}
+// requestTimeout returns the timeout for transcribing the given number of
+// samples: a fixed base plus time proportional to the audio duration, so
+// long phrases on slow servers aren't cut off while hung connections still are.
+func requestTimeout(config AudioConfig, samples int) time.Duration {
+	seconds := float64(samples) / float64(config.SampleRate*config.Channels)
+	return requestBaseTimeout + time.Duration(seconds*float64(requestTimeoutPerSecond))
+}
 
-		// Handle shifted characters (including ?)
-		needsShift := char >= 'A' && char <= 'Z' ||
-			strings.ContainsRune("?!@#$%^&*()_+{}|:\"<>~", char)
+// cancelOnClose releases a request's context when its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-		if needsShift {
-			xtest.FakeInput(k.conn, 2, 50, 0, 0, 0, 0, 0) // Press Shift
-		}
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
 
-		// Press and release the key
-		xtest.FakeInput(k.conn, 2, keycode, 0, 0, 0, 0, 0)
-		time.Sleep(5 * time.Millisecond)
-		xtest.FakeInput(k.conn, 3, keycode, 0, 0, 0, 0, 0)
-		time.Sleep(5 * time.Millisecond)
+// maxRetryAfter caps how long a 429 response's Retry-After can delay the
+// next attempt, so a long server-side window doesn't stall dictation.
+const maxRetryAfter = 30 * time.Second
 
-		if needsShift {
-			xtest.FakeInput(k.conn, 3, 50, 0, 0, 0, 0, 0) // Release Shift
-		}
+// parseRetryAfter returns the delay a Retry-After header value asks for,
+// either delay-seconds or an HTTP date, capped at maxRetryAfter. It returns
+// 0 when the value is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
 	}
-
-	// Always append a space after each chunk
-	if spaceCode, ok := k.keymap[' ']; ok {
-		xtest.FakeInput(k.conn, 2, spaceCode, 0, 0, 0, 0, 0)
-		time.Sleep(5 * time.Millisecond)
-		xtest.FakeInput(k.conn, 3, spaceCode, 0, 0, 0, 0, 0)
-		time.Sleep(5 * time.Millisecond)
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
 	}
+	if delay <= 0 {
+		return 0
+	}
+	return min(delay, maxRetryAfter)
 }
 
-func main() {
-	flag.Parse()
-	systray.Run(onReady, onExit)
-}
-
-func onReady() {
-	// Try setting a default icon first
-	systray.SetIcon(iconOff)
-	systray.SetTitle("WhisperType")
-	systray.SetTooltip("Speech-to-text (inactive)")
-
-	mQuit := systray.AddMenuItem("Quit", "Quit WhisperType")
-
-	keyboard, err := newKeyboardSimulator()
-	if err != nil {
-		log.Fatal(err)
+// logRateLimit logs the remaining request quota from OpenAI-style rate
+// limit headers, when the API sends them.
+func logRateLimit(header http.Header) {
+	remaining := header.Get("X-Ratelimit-Remaining-Requests")
+	if remaining == "" {
+		return
 	}
-
-	// Setup key monitoring for all possible modifier combinations
-	root := xproto.Setup(keyboard.conn).DefaultScreen(keyboard.conn).Root
-	modifiers := []uint16{
-		xproto.ModMask4 | xproto.ModMaskShift,                                        // Super(Command)+Shift
-		xproto.ModMask4 | xproto.ModMaskShift | xproto.ModMaskLock,                   // With CapsLock
-		xproto.ModMask4 | xproto.ModMaskShift | xproto.ModMask2,                      // With NumLock
-		xproto.ModMask4 | xproto.ModMaskShift | xproto.ModMaskLock | xproto.ModMask2, // Both
-	}
-
-	for _, mod := range modifiers {
-		err = xproto.GrabKeyChecked(
-			keyboard.conn,
-			false,
-			root,
-			mod,
-			38, // 'a' keycode
-			xproto.GrabModeAsync,
-			xproto.GrabModeAsync,
-		).Check()
-		if err != nil {
-			log.Printf("Warning: Failed to grab key with modifier %d: %v", mod, err)
-		}
+	debugf("Rate limit: %s requests remaining (limit %s, resets in %s)", remaining,
+		header.Get("X-Ratelimit-Limit-Requests"), header.Get("X-Ratelimit-Reset-Requests"))
+	if n, err := strconv.Atoi(remaining); err == nil && n <= 1 {
+		log.Printf("Rate limit nearly exhausted: %s requests remaining, resets in %s",
+			remaining, header.Get("X-Ratelimit-Reset-Requests"))
 	}
+}
 
-	// Handle quit from menu
-	go func() {
-		<-mQuit.ClickedCh
-		systray.Quit()
-	}()
+// doWithRetry executes the request built by newRequest on client, retrying connection
+// errors and 5xx/429 responses with exponential backoff and jitter up to
+// -retries attempts. A 429's Retry-After replaces the backoff delay. Each
+// attempt is bounded by timeout. Other responses are returned to the caller
+// as-is. Canceling ctx aborts the attempt in flight and any further ones.
+func doWithRetry(ctx context.Context, client *http.Client, timeout time.Duration, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	attempts := *maxRetries
+	if attempts < 1 {
+		attempts = 1
+	}
 
+	backoff := 500 * time.Millisecond
 	var (
-		isActive bool
-		cancel   context.CancelFunc
+		lastErr    error
+		retryAfter time.Duration // Server-requested delay before the next attempt
 	)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := backoff + time.Duration(rand.Int63n(int64(backoff)))
+			if retryAfter > 0 {
+				delay = retryAfter
+				retryAfter = 0
+			}
+			log.Printf("Retrying transcription in %v (attempt %d/%d): %v", delay, attempt, attempts, lastErr)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("transcription canceled: %w", ctx.Err())
+			}
+			backoff *= 2
+		}
 
-	// Handle key events
-	for {
-		ev, err := keyboard.conn.WaitForEvent()
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		req, err := newRequest(attemptCtx)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		stats.recordRequest(time.Since(start), err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests)
 		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("transcription canceled: %w", ctx.Err())
+			}
+			lastErr = fmt.Errorf("executing request: %w", err)
 			continue
 		}
 
-		switch event := ev.(type) {
-		case xproto.KeyPressEvent:
-			if event.Detail == 38 { // 'a' keycode
-				if !isActive {
-					// Start recording
-					systray.SetTemplateIcon(iconOn, iconOn)
-					systray.SetTooltip("Speech-to-text (active)")
-
-					ctx, cancelFn := context.WithCancel(context.Background())
-					cancel = cancelFn
-					go func() {
-						if err := run(ctx, keyboard); err != nil {
-							log.Printf("Error: %v", err)
-						}
-					}()
-				} else {
-					// Stop recording
-					if cancel != nil {
-						cancel()
-					}
-					systray.SetIcon(iconOff)
-					systray.SetTooltip("Speech-to-text (inactive)")
-				}
-				isActive = !isActive
+		logRateLimit(resp.Header)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			cancel()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+				lastErr = fmt.Errorf("rate limited: %s", string(bodyBytes))
+				continue
 			}
+			lastErr = fmt.Errorf("bad status: %s, body: %s", resp.Status, string(bodyBytes))
+			continue
 		}
+
+		// The timeout also covers reading the body, so release it on Close
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
 	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", attempts, lastErr)
 }
 
-func onExit() {
-	// Cleanup code here
+// post uploads body to each server in turn, starting with the one that last
+// answered, until one can be reached. A server that answers with an error
+// isn't skipped, as the next would most likely fail the same way.
+func (c *Client) post(ctx context.Context, body []byte, contentType string, timeout time.Duration) (*http.Response, error) {
+	first := int(c.preferred.Load())
+	var err error
+	for i := range c.servers {
+		index := (first + i) % len(c.servers)
+		server := c.servers[index]
+		var resp *http.Response
+		resp, err = doWithRetry(ctx, c.httpClient, timeout, func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, "POST", server, newUploadBody(body))
+			if err != nil {
+				return nil, err
+			}
+			// The wrapped body hides its length and can't be rewound, so
+			// both are set here
+			req.ContentLength = int64(len(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(newUploadBody(body)), nil
+			}
+			req.Header.Set("Content-Type", contentType)
+			if c.api == "openai" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			return req, nil
+		})
+		if err == nil {
+			if int(c.preferred.Swap(int32(index))) != index {
+				log.Printf("Switched to transcription server %s", server)
+			}
+			debugf("Transcribed by %s", server)
+			return resp, nil
+		}
+		if !isUnreachable(err) {
+			return nil, err
+		}
+		if i+1 < len(c.servers) {
+			logEvent(slog.LevelWarn, fmt.Sprintf("Transcription server %s is unreachable, trying the next: %v", server, err),
+				"server", server, "error", err)
+		}
+	}
+	return nil, err
 }
 
-func run(ctx context.Context, keyboard *KeyboardSimulator) error {
-	audioChan := make(chan AudioChunk, 10)
-	go recordLoop(ctx, recordTimeout, audioChan)
-
-	var (
-		phraseBuffer    []int16
-		transcriptLines []string
-		silenceStart    time.Time
-	)
+// server returns the endpoint the next transcription is tried on first.
+func (c *Client) server() string {
+	return c.servers[c.preferred.Load()]
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return finalizeTranscript(phraseBuffer, transcriptLines)
-		default:
-		}
+// transcriptionURLs returns the endpoints listed by -servers, or the one
+// given by transcriptionURL.
+func transcriptionURLs() []string {
+	if servers, err := parseServers(*serverList); err == nil && len(servers) > 0 {
+		return servers
+	}
+	return []string{transcriptionURL()}
+}
 
-		chunk, ok := readNextChunk(audioChan)
-		if !ok {
-			time.Sleep(50 * time.Millisecond)
+// parseServers splits list, a -servers value, into endpoint URLs. An entry
+// without a scheme is a host:port of a whisper.cpp server.
+func parseServers(list string) ([]string, error) {
+	var servers []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
 			continue
 		}
+		if !strings.Contains(entry, "://") {
+			entry = "http://" + entry + "/inference"
+		}
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -servers entry %q: %w", entry, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid -servers entry %q: no host", entry)
+		}
+		servers = append(servers, entry)
+	}
+	if list != "" && len(servers) == 0 {
+		return nil, fmt.Errorf("invalid -servers %q: no servers listed", list)
+	}
+	return servers, nil
+}
 
-		if isSilent(chunk.data, energyThreshold) {
-			if silenceStart.IsZero() {
-				silenceStart = chunk.timestamp
-				log.Printf("Silence started at %v", silenceStart)
-			}
+// transcriptionURL returns the -url flag verbatim, or the default endpoint for
+// the selected API. For whisper.cpp it is built from -host and -port.
+func transcriptionURL() string {
+	if *serverURL != "" {
+		return *serverURL
+	}
+	if *apiKind == "openai" {
+		return "https://api.openai.com/v1/audio/transcriptions"
+	}
+	return fmt.Sprintf("http://%s:%d/inference", *serverHost, *serverPort)
+}
 
-			if len(phraseBuffer) > 0 && time.Since(silenceStart) > silenceDuration {
-				text, err := transcribeChunk(phraseBuffer)
-				if err != nil {
-					return fmt.Errorf("transcription error: %w", err)
-				}
-				transcriptLines = append(transcriptLines, text)
-				log.Printf("Typing: %s", text)
-				keyboard.typeText(text)
-				phraseBuffer = nil
-				silenceStart = time.Time{}
-			}
-			continue
+// warmUpServer transcribes a short silent clip so the server loads its model
+// before the first real phrase. While that fails it retries with backoff
+// until wait has elapsed, then returns the last error.
+func warmUpServer(client *Client, wait time.Duration) error {
+	silence := make([]int16, client.config.samplesIn(500*time.Millisecond))
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		_, err := client.Transcribe(context.Background(), silence)
+		if err == nil {
+			log.Printf("Whisper server ready (warm-up took %v)", time.Since(start).Round(time.Millisecond))
+			return nil
 		}
-
-		// Speech detected
-		if !silenceStart.IsZero() {
-			log.Printf("Speech detected after %v of silence", chunk.timestamp.Sub(silenceStart))
+		if time.Now().Add(backoff).After(deadline) {
+			return err
 		}
-		silenceStart = time.Time{}
-		phraseBuffer = append(phraseBuffer, chunk.data...)
+
+		log.Printf("Waiting %v for whisper server: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 10*time.Second)
 	}
 }
 
-func readNextChunk(audioChan chan AudioChunk) (AudioChunk, bool) {
-	select {
-	case chunk := <-audioChan:
-		return chunk, true
-	default:
-		return AudioChunk{}, false
+// checkHealth reports whether any of the client's servers is up, returning
+// the first server's error when none is.
+func (c *Client) checkHealth() error {
+	var first error
+	for _, server := range c.servers {
+		err := c.checkServer(server)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
 	}
+	return first
 }
 
-func finalizeTranscript(buffer []int16, lines []string) error {
-	if len(buffer) > 0 {
-		text, err := transcribeChunk(buffer)
-		if err != nil {
-			return fmt.Errorf("final transcription error: %w", err)
-		}
-		lines = append(lines, text)
-		fmt.Printf("\nFinal transcription: %s\n", text)
+// checkServer asks server's /health endpoint whether it is up. Any answer
+// shows the server is reachable, even from servers without the endpoint,
+// except an unavailable status such as whisper.cpp's 503 while the model
+// loads or a proxy's 502 with nothing behind it.
+func (c *Client) checkServer(server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("parsing server URL: %w", err)
 	}
+	u.Path, u.RawQuery = "/health", ""
 
-	fmt.Println("\nComplete Transcript:")
-	for _, line := range lines {
-		fmt.Println(line)
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("health check: %s", resp.Status)
 	}
 	return nil
 }
 
-// recordLoop runs the 'parec' command to obtain raw audio from PulseAudio.
-// It reads fixed-size chunks corresponding to chunkDuration and sends them on audioChan.
-func recordLoop(ctx context.Context, chunkDuration time.Duration, audioChan chan<- AudioChunk) {
-	// Calculate the number of bytes (16-bit samples = 2 bytes).
-	chunkBytes := int(float64(chunkDuration)/float64(time.Second)) * sampleRate * 2
+// isUnreachable reports whether err means the server couldn't be reached
+// at all, rather than that it failed the request. A canceled request
+// doesn't count.
+func isUnreachable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled)
+}
 
-	// Start the 'parec' command.
-	cmd := exec.CommandContext(ctx, "parec", "--format=s16le", fmt.Sprintf("--rate=%d", sampleRate), fmt.Sprintf("--channels=%d", channels))
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("Failed to get parec stdout: %v", err)
-		close(audioChan)
-		return
+// spoolPhrase saves samples as a WAV file in -spool-dir and returns its
+// path. Names sort in the order the phrases were spoken.
+func spoolPhrase(samples []int16, config AudioConfig) (string, error) {
+	if err := os.MkdirAll(*spoolDir, 0o700); err != nil {
+		return "", fmt.Errorf("creating spool directory: %w", err)
 	}
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start parec: %v", err)
-		close(audioChan)
-		return
+	var wav bytes.Buffer
+	if err := writeWavToBuffer(&wav, samples, config); err != nil {
+		return "", err
 	}
+	name := fmt.Sprintf("phrase-%s.wav", time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(*spoolDir, name)
+	if err := os.WriteFile(path, wav.Bytes(), 0o600); err != nil {
+		return "", fmt.Errorf("writing spooled phrase: %w", err)
+	}
+	return path, nil
+}
 
-	buffer := make([]byte, chunkBytes)
-	for {
-		_, err := io.ReadFull(stdout, buffer)
+// transcribePhrase transcribes a phrase with t, splitting it into overlapping chunks
+// when -chunked is set or it is longer than chunkedThreshold. Chunked
+// results carry no segments.
+func transcribePhrase(ctx context.Context, t Transcriber, samples []int16, config AudioConfig) (result Transcription, err error) {
+	start := time.Now()
+	defer func() {
+		length, latency := config.durationOf(len(samples)), time.Since(start)
+		fields := []any{"phrase_ms", length.Milliseconds(), "latency_ms", latency.Milliseconds(), "chars", len(result.Text)}
 		if err != nil {
-			// Exit when context is canceled or an error occurs.
-			break
+			fields = append(fields, "error", err)
 		}
+		logEvent(slog.LevelInfo, fmt.Sprintf("Transcribed %v of audio in %v", length.Round(time.Millisecond), latency.Round(time.Millisecond)), fields...)
+	}()
+
+	if *chunked || len(samples) > config.samplesIn(chunkedThreshold) {
+		text, err := transcribeInChunks(ctx, t, samples, config)
+		return Transcription{Text: text}, err
+	}
+	if client, ok := t.(*Client); ok {
+		return client.transcribe(ctx, samples)
+	}
+	text, err := t.Transcribe(ctx, samples)
+	return Transcription{Text: text}, err
+}
+
+// transcribeInChunks processes the audio in smaller chunks with overlap
+func transcribeInChunks(ctx context.Context, t Transcriber, samples []int16, config AudioConfig) (string, error) {
+	samplesPerChunk := config.samplesIn(minChunkDuration)
+	overlapSamples := config.samplesIn(chunkOverlap)
 
-		// Copy buffer as it will be reused.
-		chunkDataBytes := make([]byte, len(buffer))
-		copy(chunkDataBytes, buffer)
+	if len(samples) <= samplesPerChunk {
+		return t.Transcribe(ctx, samples)
+	}
+
+	// Keep advancing even if the overlap isn't shorter than a chunk
+	step := samplesPerChunk - overlapSamples
+	if step <= 0 {
+		step = samplesPerChunk
+	}
 
-		nSamples := len(chunkDataBytes) / 2
-		samples := make([]int16, nSamples)
-		for i := 0; i < nSamples; i++ {
-			samples[i] = int16(binary.LittleEndian.Uint16(chunkDataBytes[i*2 : i*2+2]))
+	var words []string
+
+	// Process chunks with overlap
+	for start := 0; start < len(samples); start += step {
+		end := start + samplesPerChunk
+		if end > len(samples) {
+			end = len(samples)
 		}
 
-		audioChan <- AudioChunk{
-			timestamp: time.Now(),
-			data:      samples,
+		chunk := samples[start:end]
+		text, err := t.Transcribe(ctx, chunk)
+		if err != nil {
+			return "", fmt.Errorf("transcribing chunk at %d: %w", start, err)
 		}
-	}
-	close(audioChan)
-}
 
-// isSilent computes the average absolute amplitude of the samples.
-// It prints the average energy for debugging, then compares it to the threshold.
-func isSilent(data []int16, threshold int) bool {
-	var sum int64
-	for _, sample := range data {
-		if sample < 0 {
-			sample = -sample
+		words = mergeOverlap(words, strings.Fields(text))
+		if end == len(samples) {
+			// Later chunks would only repeat the overlap
+			break
 		}
-		sum += int64(sample)
 	}
-	avg := sum / int64(len(data))
-	// Debug: print the computed average. (Comment out the next line if too verbose.)
-	log.Printf("Computed average energy: %d", avg)
-	return avg < int64(threshold)
+
+	return strings.Join(words, " "), nil
 }
 
-// transcribeChunk sends a smaller portion of audio for transcription
-func transcribeChunk(samples []int16) (string, error) {
-	// Reuse existing transcribe function but with smaller chunks
-	wavBuffer.Reset()
+// trimRepeated returns text without its leading words that repeat the end
+// of carried, the text of audio that was transcribed again as context.
+func trimRepeated(carried []string, text string) string {
+	merged := mergeOverlap(append([]string(nil), carried...), strings.Fields(text))
+	return strings.Join(merged[len(carried):], " ")
+}
 
-	if err := writeWavToBuffer(&wavBuffer, samples, sampleRate, channels); err != nil {
-		return "", fmt.Errorf("writing WAV buffer: %w", err)
+// mergeOverlap appends next to words, dropping the longest prefix of next that
+// repeats a suffix of words. Overlapping chunks transcribe the same audio at
+// their seams, so without this the shared words would appear twice. At most
+// -overlap-words trailing words are compared, and the two transcriptions of
+// the seam may differ by a word either way ("gonna" and "going to").
+func mergeOverlap(words, next []string) []string {
+	maxOverlap := min(len(words), len(next)+1, *dedupWords)
+	for n := maxOverlap; n > 0; n-- {
+		for _, m := range []int{n, n + 1, n - 1} {
+			if m < 1 || m > len(next) {
+				continue
+			}
+			if wordsMatch(words[len(words)-n:], next[:m]) {
+				return append(words, next[m:]...)
+			}
+		}
 	}
+	return append(words, next...)
+}
 
-	var b bytes.Buffer
-	writer := multipart.NewWriter(&b)
+// fuzzyMatchLength is the shortest seam, in letters, compared fuzzily. Below
+// it a single edit turns one common word into another ("the" and "they").
+const fuzzyMatchLength = 8
 
-	part, err := writer.CreateFormFile("file", "audio.wav")
-	if err != nil {
-		return "", fmt.Errorf("creating form file: %w", err)
+// wordsMatch reports whether two word slices say the same thing, ignoring
+// case, punctuation and common contractions. Longer seams also match with a
+// few letters different, at most one edit per four letters.
+func wordsMatch(a, b []string) bool {
+	left, right := seamText(a), seamText(b)
+	if left == right {
+		return true
 	}
+	longest := max(len(left), len(right))
+	return longest >= fuzzyMatchLength && editDistance(left, right)*4 <= longest
+}
 
-	if _, err := io.Copy(part, &wavBuffer); err != nil {
-		return "", fmt.Errorf("copying buffer: %w", err)
+// spokenContractions expands informal contractions, after normalizeWord,
+// so that both transcriptions of a seam spell them the same way.
+var spokenContractions = map[string]string{
+	"gonna": "going to",
+	"wanna": "want to",
+	"gotta": "got to",
+	"kinda": "kind of",
+	"sorta": "sort of",
+	"lemme": "let me",
+	"gimme": "give me",
+	"dunno": "dont know",
+	"im":    "i am",
+	"youre": "you are",
+	"dont":  "do not",
+	"cant":  "cannot",
+	"ive":   "i have",
+}
+
+// seamText joins words normalized for comparison, without spaces.
+func seamText(words []string) string {
+	var text strings.Builder
+	for _, word := range words {
+		word = normalizeWord(word)
+		if expanded, ok := spokenContractions[word]; ok {
+			word = strings.ReplaceAll(expanded, " ", "")
+		}
+		text.WriteString(word)
 	}
+	return text.String()
+}
 
-	if err := writer.WriteField("response_format", "json"); err != nil {
-		return "", fmt.Errorf("adding response format field: %w", err)
+// editDistance returns the Levenshtein distance between a and b in bytes.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
 	}
-	if err := writer.Close(); err != nil {
-		return "", fmt.Errorf("closing writer: %w", err)
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
 	}
+	return previous[len(b)]
+}
 
-	serverURL := fmt.Sprintf("http://%s:%d/inference", *serverHost, *serverPort)
-	req, err := http.NewRequest("POST", serverURL, &b)
+// normalizeWord lowercases a word and strips everything but letters and digits.
+func normalizeWord(word string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, word)
+}
+
+// transcribeFile transcribes a WAV file with t and prints the text to stdout.
+func transcribeFile(t Transcriber, path string, config AudioConfig) error {
+	samples, format, err := readWavFile(path)
 	if err != nil {
-		return "", fmt.Errorf("creating request: %w", err)
+		return err
+	}
+	if format.SampleRate != config.SampleRate || format.Channels != config.Channels {
+		if config.SampleRate != 16000 || config.Channels != 1 {
+			return fmt.Errorf("%s is %d Hz with %d channels, expected %d Hz with %d channels",
+				path, format.SampleRate, format.Channels, config.SampleRate, config.Channels)
+		}
+		log.Printf("Resampling %s from %d Hz with %d channels to 16 kHz mono", path, format.SampleRate, format.Channels)
+		samples = resampleTo16kMono(samples, format.SampleRate, format.Channels)
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	resp, err := httpClient.Do(req)
+	text, err := transcribeInChunks(context.Background(), t, samples, config)
 	if err != nil {
-		return "", fmt.Errorf("executing request: %w", err)
+		return fmt.Errorf("transcribing %s: %w", path, err)
 	}
-	defer resp.Body.Close()
+	fmt.Println(strings.TrimSpace(text))
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("bad status: %s, body: %s", resp.Status, string(bodyBytes))
+// transcribeStdin runs a session over PCM read from stdin without the tray
+// or hotkey, printing phrases to stdout as -dry-run does.
+func transcribeStdin(t Transcriber) error {
+	log.Printf("Reading %d Hz audio with %d channels from stdin", audioConfig.SampleRate, audioConfig.Channels)
+	recorder := &Recorder{
+		typer:        PrintTyper{},
+		transcriber:  t,
+		source:       readStdinAudio,
+		undoRequests: make(chan struct{}, 1),
 	}
+	return run(context.Background(), recorder)
+}
 
-	var result struct {
-		Text string `json:"text"`
+// recordOnce runs a session for -once without the tray or hotkey. It types
+// the first phrase and returns, or stops early on SIGINT or SIGTERM.
+func recordOnce(t Transcriber) error {
+	typer, _, err := setupInput()
+	if err != nil {
+		return err
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("decoding response: %w", err)
+	if *dryRun {
+		typer = PrintTyper{}
 	}
-
-	// Clean up the text
-	text := strings.TrimSpace(result.Text)
-	if text == "[BLANK_AUDIO]" || text == "\n[BLANK_AUDIO]" {
-		return "", nil
+	recorder := &Recorder{
+		typer:        typer,
+		transcriber:  t,
+		undoRequests: make(chan struct{}, 1),
 	}
 
-	return text, nil
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Recording one phrase")
+	playCue(soundStart)
+	return run(ctx, recorder)
 }
 
-// transcribeInChunks processes the audio in smaller chunks with overlap
-func transcribeInChunks(samples []int16) (string, error) {
-	samplesPerChunk := int(minChunkDuration.Seconds() * float64(sampleRate))
-	overlapSamples := int(chunkOverlap.Seconds() * float64(sampleRate))
+// resampleTo16kMono averages interleaved channels down to mono and resamples
+// to 16 kHz with linear interpolation.
+func resampleTo16kMono(samples []int16, srcRate, srcChannels int) []int16 {
+	const dstRate = 16000
 
-	if len(samples) <= samplesPerChunk {
-		return transcribeChunk(samples)
+	frames := len(samples) / srcChannels
+	if frames == 0 {
+		return nil
 	}
 
-	var fullText strings.Builder
-
-	// Process chunks with overlap
-	for start := 0; start < len(samples); start += samplesPerChunk - overlapSamples {
-		end := start + samplesPerChunk
-		if end > len(samples) {
-			end = len(samples)
+	mono := make([]float64, frames)
+	for i := range mono {
+		var sum float64
+		for c := 0; c < srcChannels; c++ {
+			sum += float64(samples[i*srcChannels+c])
 		}
+		mono[i] = sum / float64(srcChannels)
+	}
 
-		chunk := samples[start:end]
-		text, err := transcribeChunk(chunk)
-		if err != nil {
-			return "", fmt.Errorf("transcribing chunk at %d: %w", start, err)
+	outLen := int(int64(frames) * dstRate / int64(srcRate))
+	out := make([]int16, outLen)
+	step := float64(srcRate) / dstRate
+	for i := range out {
+		pos := float64(i) * step
+		idx := int(pos)
+		frac := pos - float64(idx)
+		value := mono[idx]
+		if idx+1 < frames {
+			value += (mono[idx+1] - mono[idx]) * frac
 		}
+		out[i] = int16(math.Round(value))
+	}
+	return out
+}
 
-		fullText.WriteString(text)
-		fullText.WriteString(" ") // Add space between chunks
+// WAV format tags readWavFile decodes. WAVE_FORMAT_EXTENSIBLE files carry
+// one of the others as the first two bytes of their subformat GUID.
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// readWavFile decodes an 8, 16, 24 or 32-bit PCM or a 32 or 64-bit float WAV
+// file into interleaved 16-bit samples. The returned AudioConfig describes
+// those samples, so its BitsPerSample is always 16.
+func readWavFile(path string) ([]int16, AudioConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, AudioConfig{}, fmt.Errorf("reading WAV file: %w", err)
 	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, AudioConfig{}, fmt.Errorf("%s is not a WAV file", path)
+	}
+
+	var (
+		format    AudioConfig
+		hasFormat bool
+		encoding  uint16 // wavFormatPCM or wavFormatFloat
+		bits      int    // Bits per sample in the file
+	)
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := data[offset+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, AudioConfig{}, fmt.Errorf("%s: fmt chunk too short", path)
+			}
+			encoding = binary.LittleEndian.Uint16(body[0:2])
+			if encoding == wavFormatExtensible {
+				if len(body) < 26 {
+					return nil, AudioConfig{}, fmt.Errorf("%s: extensible fmt chunk too short", path)
+				}
+				encoding = binary.LittleEndian.Uint16(body[24:26])
+			}
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			if err := checkWavEncoding(encoding, bits); err != nil {
+				return nil, AudioConfig{}, fmt.Errorf("%s: %w", path, err)
+			}
+			format = AudioConfig{
+				Channels:      int(binary.LittleEndian.Uint16(body[2:4])),
+				SampleRate:    int(binary.LittleEndian.Uint32(body[4:8])),
+				BitsPerSample: 16,
+			}
+			if err := format.validate(); err != nil {
+				return nil, AudioConfig{}, fmt.Errorf("%s: %w", path, err)
+			}
+			hasFormat = true
+		case "data":
+			if !hasFormat {
+				return nil, AudioConfig{}, fmt.Errorf("%s: data chunk before fmt chunk", path)
+			}
+			return decodeWavSamples(body, encoding, bits), format, nil
+		}
 
-	return fullText.String(), nil
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+	return nil, AudioConfig{}, fmt.Errorf("%s: no data chunk", path)
 }
 
-// writeWavToBuffer writes WAV data directly to a buffer
-func writeWavToBuffer(buffer *bytes.Buffer, samples []int16, sampleRate, channels int) error {
-	const bitsPerSample = 16
-	byteRate := uint32(sampleRate * channels * (bitsPerSample / 8))
-	blockAlign := uint16(channels * (bitsPerSample / 8))
+// checkWavEncoding returns an error unless decodeWavSamples handles samples
+// of the given format tag and size.
+func checkWavEncoding(encoding uint16, bits int) error {
+	switch {
+	case encoding == wavFormatPCM && (bits == 8 || bits == 16 || bits == 24 || bits == 32):
+		return nil
+	case encoding == wavFormatFloat && (bits == 32 || bits == 64):
+		return nil
+	case encoding == wavFormatPCM || encoding == wavFormatFloat:
+		return fmt.Errorf("unsupported bits per sample %d", bits)
+	default:
+		return fmt.Errorf("unsupported audio format %d (only PCM and float)", encoding)
+	}
+}
 
-	var dataBuf bytes.Buffer
-	for _, sample := range samples {
-		if err := binary.Write(&dataBuf, binary.LittleEndian, sample); err != nil {
-			return fmt.Errorf("writing sample: %w", err)
+// decodeWavSamples converts a WAV data chunk to 16-bit samples. PCM deeper
+// than 16 bits keeps its top 16; 8-bit PCM is unsigned and centred on 128;
+// float samples are scaled from [-1, 1] and clipped. A trailing partial
+// sample is ignored.
+func decodeWavSamples(data []byte, encoding uint16, bits int) []int16 {
+	size := bits / 8
+	samples := make([]int16, len(data)/size)
+	for i := range samples {
+		b := data[i*size : i*size+size]
+		switch {
+		case encoding == wavFormatFloat && bits == 32:
+			samples[i] = floatToSample(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+		case encoding == wavFormatFloat:
+			samples[i] = floatToSample(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		case bits == 8:
+			samples[i] = (int16(b[0]) - 128) << 8
+		case bits == 16:
+			samples[i] = int16(binary.LittleEndian.Uint16(b))
+		default:
+			// 24 and 32-bit: the last two bytes are the most significant
+			samples[i] = int16(binary.LittleEndian.Uint16(b[size-2:]))
 		}
 	}
-	dataSize := uint32(dataBuf.Len())
+	return samples
+}
+
+// floatToSample converts a float sample in [-1, 1] to 16 bits, clipping
+// values outside that range. NaN becomes silence.
+func floatToSample(value float64) int16 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	return int16(math.Round(max(-1, min(1, value)) * math.MaxInt16))
+}
+
+// writeWavToBuffer writes WAV data directly to a buffer. The data chunk is
+// len(samples)*2 bytes, which is always even, so RIFF never needs a pad byte;
+// zero samples produce a valid WAV with an empty data chunk. Samples are
+// encoded straight into buffer after the header, so a phrase is only held
+// once more as WAV.
+func writeWavToBuffer(buffer *bytes.Buffer, samples []int16, config AudioConfig) error {
+	byteRate := uint32(config.bytesPerSecond())
+	blockAlign := uint16(config.Channels * (config.BitsPerSample / 8))
+	dataSize := uint32(len(samples) * 2)
 
 	// Write headers
 	buffer.Write([]byte("RIFF"))
@@ -552,20 +4966,79 @@ func writeWavToBuffer(buffer *bytes.Buffer, samples []int16, sampleRate, channel
 	buffer.Write([]byte("fmt "))
 	binary.Write(buffer, binary.LittleEndian, uint32(16)) // PCM subchunk size
 	binary.Write(buffer, binary.LittleEndian, uint16(1))  // AudioFormat PCM = 1
-	binary.Write(buffer, binary.LittleEndian, uint16(channels))
-	binary.Write(buffer, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(buffer, binary.LittleEndian, uint16(config.Channels))
+	binary.Write(buffer, binary.LittleEndian, uint32(config.SampleRate))
 	binary.Write(buffer, binary.LittleEndian, uint32(byteRate))
 	binary.Write(buffer, binary.LittleEndian, blockAlign)
-	binary.Write(buffer, binary.LittleEndian, uint16(bitsPerSample))
+	binary.Write(buffer, binary.LittleEndian, uint16(config.BitsPerSample))
 
 	// "data" subchunk.
 	buffer.Write([]byte("data"))
 	binary.Write(buffer, binary.LittleEndian, uint32(dataSize))
-	buffer.Write(dataBuf.Bytes())
+	buffer.Grow(int(dataSize))
+	data := buffer.AvailableBuffer()
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+	}
+	buffer.Write(data)
 
 	return nil
 }
 
+// uploadFormat is how audio in an -encode format is named and typed in the
+// multipart upload.
+type uploadFormat struct {
+	filename    string
+	contentType string
+}
+
+// uploadFormats maps each -encode value to its upload format. Opus is sent
+// in an Ogg container, which both whisper.cpp (built with ffmpeg support)
+// and OpenAI accept.
+var uploadFormats = map[string]uploadFormat{
+	"wav":  {"audio.wav", "audio/wav"},
+	"flac": {"audio.flac", "audio/flac"},
+	"opus": {"audio.ogg", "audio/ogg"},
+}
+
+// audioEncoders lists, for each compressed -encode format, the commands
+// tried in order to convert a WAV on stdin to that format on stdout.
+var audioEncoders = map[string][][]string{
+	"flac": {
+		{"ffmpeg", "-loglevel", "error", "-f", "wav", "-i", "pipe:0", "-f", "flac", "pipe:1"},
+		{"flac", "--silent", "--stdout", "-"},
+	},
+	"opus": {
+		{"ffmpeg", "-loglevel", "error", "-f", "wav", "-i", "pipe:0", "-c:a", "libopus", "-b:a", "24k", "-f", "ogg", "pipe:1"},
+		{"opusenc", "--quiet", "--bitrate", "24", "-", "-"},
+	},
+}
+
+// resolveEncoder returns the first installed encoder command for format.
+func resolveEncoder(format string) ([]string, error) {
+	var tried []string
+	for _, command := range audioEncoders[format] {
+		if _, err := exec.LookPath(command[0]); err == nil {
+			return command, nil
+		}
+		tried = append(tried, command[0])
+	}
+	return nil, fmt.Errorf("no %s encoder found (tried %s)", format, strings.Join(tried, ", "))
+}
+
+// encodeAudio pipes wav through the encoder command and returns its output.
+func encodeAudio(command []string, wav []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(wav)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
 // clearScreen sends ANSI escape codes to clear the terminal.
 func clearScreen() {
 	fmt.Print("\033[H\033[2J")
@@ -0,0 +1,1389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	audioConfig = AudioConfig{SampleRate: 16000, Channels: 1, BitsPerSample: 16}
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testClient returns a Client sending to server with the default flags.
+func testClient(server *httptest.Server) *Client {
+	client := newClient(audioConfig, "")
+	client.servers = []string{server.URL}
+	return client
+}
+
+// TestTranscribeCanceled checks that canceling the context aborts a request
+// a slow server hasn't answered, rather than waiting for the timeout.
+func TestTranscribeCanceled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testClient(server).Transcribe(ctx, make([]int16, audioConfig.samplesIn(time.Second)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Transcribe() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Transcribe() returned after %v, want promptly after cancel", elapsed)
+	}
+	if isUnreachable(err) {
+		t.Errorf("isUnreachable(%v) = true, want false for a canceled request", err)
+	}
+}
+
+// TestTranscribeCanceledWhileQueued checks that canceling the context also
+// ends the wait for a -max-requests slot held by a slow request.
+func TestTranscribeCanceledWhileQueued(t *testing.T) {
+	setFlags(t, map[string]string{"max-requests": "1"})
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"text": "slow"}`)
+	}))
+	defer server.Close()
+	client := testClient(server)
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := client.Transcribe(context.Background(), make([]int16, audioConfig.samplesIn(time.Second)))
+		slow <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.Transcribe(ctx, make([]int16, audioConfig.samplesIn(time.Second)))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("queued Transcribe() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("queued Transcribe() returned after %v, want promptly after cancel", elapsed)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("slow Transcribe() error = %v", err)
+	}
+}
+
+// TestTranscribeCanceledDuringBackoff checks that canceling the context
+// ends the wait between retries.
+func TestTranscribeCanceledDuringBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "loading model", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testClient(server).Transcribe(ctx, make([]int16, audioConfig.samplesIn(time.Second)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Transcribe() error = %v, want context.Canceled", err)
+	}
+	// The first backoff is at least 500ms
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Transcribe() returned after %v, want promptly after cancel", elapsed)
+	}
+}
+
+// wavHeader is the 44-byte header writeWavToBuffer writes before the samples.
+type wavHeader struct {
+	RIFF          [4]byte
+	RIFFSize      uint32
+	WAVE          [4]byte
+	Fmt           [4]byte
+	FmtSize       uint32
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	Data          [4]byte
+	DataSize      uint32
+}
+
+func TestWriteWavToBuffer(t *testing.T) {
+	for _, samples := range [][]int16{nil, {1}, {1, -2, 3}, make([]int16, 16000)} {
+		var buffer bytes.Buffer
+		if err := writeWavToBuffer(&buffer, samples, audioConfig); err != nil {
+			t.Fatalf("writeWavToBuffer(%d samples) error = %v", len(samples), err)
+		}
+		var header wavHeader
+		if err := binary.Read(&buffer, binary.LittleEndian, &header); err != nil {
+			t.Fatalf("reading header of %d samples: %v", len(samples), err)
+		}
+		dataSize := uint32(len(samples) * 2)
+		want := wavHeader{
+			RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+			RIFFSize:      36 + dataSize,
+			WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+			Fmt:           [4]byte{'f', 'm', 't', ' '},
+			FmtSize:       16,
+			AudioFormat:   1,
+			Channels:      1,
+			SampleRate:    16000,
+			ByteRate:      32000,
+			BlockAlign:    2,
+			BitsPerSample: 16,
+			Data:          [4]byte{'d', 'a', 't', 'a'},
+			DataSize:      dataSize,
+		}
+		if header != want {
+			t.Errorf("header of %d samples = %+v, want %+v", len(samples), header, want)
+		}
+		if buffer.Len() != int(dataSize) {
+			t.Errorf("%d samples wrote %d data bytes, want %d", len(samples), buffer.Len(), dataSize)
+		}
+		for i, sample := range samples {
+			if got := int16(binary.LittleEndian.Uint16(buffer.Next(2))); got != sample {
+				t.Errorf("sample %d = %d, want %d", i, got, sample)
+				break
+			}
+		}
+	}
+}
+
+// recordingTyper records typed text, and key presses as "<Key>".
+type recordingTyper struct {
+	output []string
+}
+
+func (r *recordingTyper) TypeText(text string) {
+	r.output = append(r.output, text)
+}
+
+func (r *recordingTyper) PressKey(spec string) error {
+	r.output = append(r.output, "<"+spec+">")
+	return nil
+}
+
+// scriptedTranscriber returns texts in turn, and "" once they run out. It
+// records the samples of each request.
+type scriptedTranscriber struct {
+	texts    []string
+	calls    int
+	requests [][]int16
+}
+
+func (s *scriptedTranscriber) Transcribe(ctx context.Context, samples []int16) (string, error) {
+	s.calls++
+	s.requests = append(s.requests, slices.Clone(samples))
+	if len(s.texts) == 0 {
+		return "", nil
+	}
+	text := s.texts[0]
+	s.texts = s.texts[1:]
+	return text, nil
+}
+
+// testChunks returns 100ms chunks starting at start, one per character of
+// script: '#' for speech and '.' for silence.
+func testChunks(start time.Time, script string) []AudioChunk {
+	var chunks []AudioChunk
+	for i, c := range script {
+		data := make([]int16, audioConfig.samplesIn(100*time.Millisecond))
+		if c == '#' {
+			for j := range data {
+				data[j] = 1000 - 2000*int16(j%2)
+			}
+		}
+		chunks = append(chunks, AudioChunk{timestamp: start.Add(time.Duration(i) * 100 * time.Millisecond), data: data})
+	}
+	return chunks
+}
+
+// TestSessionPhrases feeds scripted audio through a session, then stops
+// it, and checks what was transcribed and typed. The default flags apply:
+// a 300ms pause ends a phrase, a 1.2s one a sentence, and a phrase starts
+// after two chunks of speech.
+func TestSessionPhrases(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		flags  map[string]string
+		script string
+		texts  []string
+		calls  int      // Transcriptions, including the final one
+		output []string // What was typed
+	}{
+		{
+			name:   "silence",
+			script: "..........",
+		},
+		{
+			name:   "click",
+			script: "#.........",
+		},
+		{
+			name:   "speech then pause",
+			script: "###....",
+			texts:  []string{"hello world"},
+			calls:  1,
+			output: []string{"Hello world "},
+		},
+		{
+			name:   "breath pause",
+			script: "###..###....",
+			texts:  []string{"hello world"},
+			calls:  1,
+			output: []string{"Hello world "},
+		},
+		{
+			name:   "sentence pause",
+			script: "###.............",
+			texts:  []string{"hello world"},
+			calls:  1,
+			output: []string{"Hello world ", "<BackSpace>", ". "},
+		},
+		{
+			name:   "two phrases",
+			script: "###....###....",
+			texts:  []string{"hello", "world"},
+			calls:  2,
+			output: []string{"Hello ", "world "},
+		},
+		{
+			name:   "stop while speaking",
+			script: "####",
+			texts:  []string{"hello world"},
+			calls:  1,
+			output: []string{"Hello world "},
+		},
+		{
+			name:   "stop after a phrase",
+			script: "###....####",
+			texts:  []string{"hello", "world"},
+			calls:  2,
+			output: []string{"Hello ", "world "},
+		},
+		{
+			name:   "newline after each phrase",
+			flags:  map[string]string{"insert-newline-between-phrases": "true"},
+			script: "###....###....",
+			texts:  []string{"hello", "world"},
+			calls:  2,
+			output: []string{"Hello ", "<BackSpace>", "<Return>", "World ", "<BackSpace>", "<Return>"},
+		},
+		{
+			name:   "newline after the final phrase",
+			flags:  map[string]string{"insert-newline-between-phrases": "true"},
+			script: "###....####",
+			texts:  []string{"hello", "world"},
+			calls:  2,
+			output: []string{"Hello ", "<BackSpace>", "<Return>", "World ", "<BackSpace>", "<Return>"},
+		},
+		{
+			name:   "standalone",
+			flags:  map[string]string{"standalone": "true"},
+			script: "####",
+			texts:  []string{"hello world"},
+			calls:  1,
+			output: []string{"Hello world ", "<BackSpace>"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.flags)
+			typer := &recordingTyper{}
+			transcriber := &scriptedTranscriber{texts: test.texts}
+			s, err := newSession(&Recorder{typer: typer, transcriber: transcriber})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			for _, chunk := range testChunks(time.Now(), test.script) {
+				if s.handleChunk(ctx, chunk) {
+					t.Fatalf("handleChunk() ended the session")
+				}
+			}
+			if err := s.finish(); err != nil {
+				t.Fatalf("finish() error = %v", err)
+			}
+			s.typer.Close()
+
+			if transcriber.calls != test.calls {
+				t.Errorf("transcribed %d times, want %d", transcriber.calls, test.calls)
+			}
+			if !slices.Equal(typer.output, test.output) {
+				t.Errorf("typed %q, want %q", typer.output, test.output)
+			}
+		})
+	}
+}
+
+// uploadedForm is what a test server received in a transcription request.
+type uploadedForm struct {
+	fields   map[string]string
+	file     []byte
+	filename string
+}
+
+// transcriptionServer returns a server answering each request with text as
+// the transcription and sending what it received on forms.
+func transcriptionServer(t *testing.T, fileField, text string) (*httptest.Server, <-chan uploadedForm) {
+	forms := make(chan uploadedForm, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parsing upload: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form := uploadedForm{fields: make(map[string]string)}
+		for name, values := range req.MultipartForm.Value {
+			form.fields[name] = values[0]
+		}
+		file, header, err := req.FormFile(fileField)
+		if err != nil {
+			t.Errorf("reading %s field: %v", fileField, err)
+		} else {
+			form.file, _ = io.ReadAll(file)
+			form.filename = header.Filename
+		}
+		forms <- form
+		fmt.Fprintf(w, `{"text": %q}`, text)
+	}))
+	t.Cleanup(server.Close)
+	return server, forms
+}
+
+func TestClientTranscribe(t *testing.T) {
+	server, forms := transcriptionServer(t, "file", " hello world\n")
+	client := testClient(server)
+	client.language = "en"
+	samples := []int16{1, 2, 3, 4}
+
+	text, err := client.Transcribe(context.Background(), samples)
+	if err != nil {
+		t.Fatalf("Transcribe() error = %v", err)
+	}
+	if text != "hello world" {
+		t.Errorf("Transcribe() = %q, want %q", text, "hello world")
+	}
+
+	form := <-forms
+	if form.filename != "audio.wav" {
+		t.Errorf("uploaded file name = %q, want audio.wav", form.filename)
+	}
+	var want bytes.Buffer
+	writeWavToBuffer(&want, samples, audioConfig)
+	if !bytes.Equal(form.file, want.Bytes()) {
+		t.Errorf("uploaded file = %x, want the WAV %x", form.file, want.Bytes())
+	}
+	for field, value := range map[string]string{"response_format": "json", "language": "en"} {
+		if form.fields[field] != value {
+			t.Errorf("%s field = %q, want %q", field, form.fields[field], value)
+		}
+	}
+}
+
+// TestClientTranscribeFields checks the -file-field and -format-field
+// names, and that a response reporting the language is asked for while
+// it is being detected.
+func TestClientTranscribeFields(t *testing.T) {
+	server, forms := transcriptionServer(t, "audio", "hello")
+	client := testClient(server)
+	client.fileField, client.formatField = "audio", "output"
+	client.language, client.langLock = "", 3
+
+	if _, err := client.Transcribe(context.Background(), []int16{1, 2}); err != nil {
+		t.Fatalf("Transcribe() error = %v", err)
+	}
+	form := <-forms
+	if form.fields["output"] != "verbose_json" {
+		t.Errorf("output field = %q, want verbose_json", form.fields["output"])
+	}
+	if _, ok := form.fields["response_format"]; ok {
+		t.Errorf("sent a response_format field with -format-field set")
+	}
+}
+
+func TestClientTranscribeFiltersBlank(t *testing.T) {
+	for _, response := range []string{"[BLANK_AUDIO]", " [BLANK_AUDIO] ", "(upbeat music)"} {
+		server, _ := transcriptionServer(t, "file", response)
+		text, err := testClient(server).Transcribe(context.Background(), []int16{1, 2})
+		if err != nil {
+			t.Fatalf("Transcribe() error = %v", err)
+		}
+		if text != "" {
+			t.Errorf("Transcribe() with response %q = %q, want it dropped", response, text)
+		}
+	}
+}
+
+// sine returns duration of a sine wave at 16kHz.
+func sine(freq, amplitude float64, duration time.Duration) []int16 {
+	samples := make([]int16, audioConfig.samplesIn(duration))
+	for i := range samples {
+		samples[i] = int16(amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(audioConfig.SampleRate)))
+	}
+	return samples
+}
+
+// whiteNoise returns duration of uniform noise between -amplitude and
+// amplitude.
+func whiteNoise(amplitude int, duration time.Duration) []int16 {
+	random := rand.New(rand.NewSource(1))
+	samples := make([]int16, audioConfig.samplesIn(duration))
+	for i := range samples {
+		samples[i] = int16(random.Intn(2*amplitude+1) - amplitude)
+	}
+	return samples
+}
+
+func TestDetectVoiceActivity(t *testing.T) {
+	params := vadParams{energyThreshold: energyThreshold, zcrThreshold: zcrThreshold}
+	for _, test := range []struct {
+		name  string
+		data  []int16
+		voice bool
+	}{
+		{"empty", nil, false},
+		{"digital silence", make([]int16, 16000), false},
+		{"quiet hum", sine(50, 60, time.Second), false},
+		{"quiet tone", sine(440, 60, time.Second), false},
+		{"faint noise", whiteNoise(60, time.Second), false},
+		{"loud tone", sine(440, 3000, time.Second), true},
+		{"loud low tone", sine(100, 1000, time.Second), true},
+		// A fricative such as "s" is quiet but crosses zero often
+		{"quiet hiss", whiteNoise(150, time.Second), true},
+		{"loud noise", whiteNoise(5000, time.Second), true},
+	} {
+		if got := detectVoiceActivity(test.data, params); got != test.voice {
+			t.Errorf("detectVoiceActivity(%s) = %v, want %v (energy %d, zero crossings %.3f)", test.name, got, test.voice,
+				averageEnergy(test.data), zeroCrossingRate(test.data, params.energyThreshold))
+		}
+	}
+}
+
+func TestMergeOverlap(t *testing.T) {
+	for _, test := range []struct {
+		words, next, want string
+	}{
+		{"", "the quick brown", "the quick brown"},
+		{"the quick", "the quick brown fox", "the quick brown fox"},
+		{"jumped over the quick", "the quick brown fox", "jumped over the quick brown fox"},
+		{"over the Quick,", "quick brown fox", "over the Quick, brown fox"},
+		{"the quick brown.", "Brown fox jumps", "the quick brown. fox jumps"},
+		{"the quick brown", "fox jumps", "the quick brown fox jumps"},
+		{"the quick brown", "the quick brown", "the quick brown"},
+	} {
+		got := strings.Join(mergeOverlap(strings.Fields(test.words), strings.Fields(test.next)), " ")
+		if got != test.want {
+			t.Errorf("mergeOverlap(%q, %q) = %q, want %q", test.words, test.next, got, test.want)
+		}
+	}
+}
+
+// TestTranscribeInChunks checks that the words transcribed twice where
+// chunks overlap appear once in the result.
+func TestTranscribeInChunks(t *testing.T) {
+	// Two seconds are sent as three one-second chunks, half a second apart
+	transcriber := &scriptedTranscriber{texts: []string{
+		"The quick brown fox",
+		"brown fox jumps over",
+		"Jumps over the lazy dog.",
+	}}
+	text, err := transcribeInChunks(context.Background(), transcriber, make([]int16, audioConfig.samplesIn(2*time.Second)), audioConfig)
+	if err != nil {
+		t.Fatalf("transcribeInChunks() error = %v", err)
+	}
+	if want := "The quick brown fox jumps over the lazy dog."; text != want {
+		t.Errorf("transcribeInChunks() = %q, want %q", text, want)
+	}
+	if transcriber.calls != 3 {
+		t.Errorf("transcribed %d chunks, want 3", transcriber.calls)
+	}
+}
+
+func TestIsHallucination(t *testing.T) {
+	for text, want := range map[string]bool{
+		"[BLANK_AUDIO]":                     true,
+		"[MUSIC PLAYING]":                   true,
+		"(upbeat music)":                    true,
+		"*music*":                           true,
+		"♪ la la la ♪":                      true,
+		"Thanks for watching!":              true,
+		"Thank you so much for watching.":   true,
+		"Please subscribe to my channel.":   true,
+		"Hello world":                       false,
+		"I said [quote] earlier":            false,
+		"Thanks for watching the kids":      false,
+		"Please send me the file":           false,
+		"Thank you for coming (all of you)": false,
+	} {
+		if got := isHallucination(text); got != want {
+			t.Errorf("isHallucination(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestLoadFilters(t *testing.T) {
+	defaults := hallucinationFilters
+	t.Cleanup(func() { hallucinationFilters = defaults })
+
+	path := filepath.Join(t.TempDir(), "filters")
+	if err := os.WriteFile(path, []byte("# Custom filters\n\n^you$\n(?i)^bye\\.?$\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFilters(path); err != nil {
+		t.Fatalf("loadFilters() error = %v", err)
+	}
+	for text, want := range map[string]bool{"you": true, "Bye.": true, "[BLANK_AUDIO]": false, "you know": false} {
+		if got := isHallucination(text); got != want {
+			t.Errorf("after loadFilters, isHallucination(%q) = %v, want %v", text, got, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("^ok$\n(unclosed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFilters(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("loadFilters() with an invalid expression error = %v, want one naming line 2", err)
+	}
+}
+
+// interleavedTone returns duration of a 440Hz tone at rate, with the given
+// amplitude for each channel.
+func interleavedTone(rate int, amplitudes []float64, duration time.Duration) []int16 {
+	frames := int(duration.Seconds() * float64(rate))
+	samples := make([]int16, 0, frames*len(amplitudes))
+	for i := range frames {
+		value := math.Sin(2 * math.Pi * 440 * float64(i) / float64(rate))
+		for _, amplitude := range amplitudes {
+			samples = append(samples, int16(math.Round(amplitude*value)))
+		}
+	}
+	return samples
+}
+
+func TestResampleTo16kMono(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		rate       int
+		amplitudes []float64
+		want       []int16
+	}{
+		{"44.1kHz stereo", 44100, []float64{10000, 10000}, sine(440, 10000, time.Second)},
+		{"48kHz mono", 48000, []float64{10000}, sine(440, 10000, time.Second)},
+		{"8kHz mono", 8000, []float64{10000}, sine(440, 10000, time.Second)},
+		{"channels averaged", 48000, []float64{10000, 2000}, sine(440, 6000, time.Second)},
+		{"opposite channels cancel", 44100, []float64{10000, -10000}, make([]int16, 16000)},
+	} {
+		got := resampleTo16kMono(interleavedTone(test.rate, test.amplitudes, time.Second), test.rate, len(test.amplitudes))
+		if len(got) != len(test.want) {
+			t.Errorf("%s: resampled to %d samples, want %d", test.name, len(got), len(test.want))
+			continue
+		}
+		// Linear interpolation between 8kHz samples of a 440Hz tone is off
+		// by up to about 1.5% of its amplitude. The last sample has no
+		// next one to interpolate towards, so it isn't compared.
+		worst := 0.0
+		for i := range len(got) - 1 {
+			worst = max(worst, math.Abs(float64(got[i])-float64(test.want[i])))
+		}
+		if worst > 300 {
+			t.Errorf("%s: resampled tone differs by up to %.0f, want at most 300", test.name, worst)
+		}
+	}
+
+	if got := resampleTo16kMono([]int16{1}, 44100, 2); got != nil {
+		t.Errorf("resampleTo16kMono of half a frame = %v, want nil", got)
+	}
+}
+
+// TestEmptyChunk checks that empty chunks, as a short final read can
+// produce, count as silence and don't calibrate the noise floor.
+func TestEmptyChunk(t *testing.T) {
+	if got := averageEnergy(nil); got != 0 {
+		t.Errorf("averageEnergy(nil) = %d, want 0", got)
+	}
+	for _, spec := range []string{"80", "auto"} {
+		detector, err := newSilenceDetector(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !detector.isSilent([]int16{}) {
+			t.Errorf("isSilent(empty) with threshold %s = false, want true", spec)
+		}
+		if detector.calibrated {
+			t.Errorf("isSilent(empty) with threshold %s calibrated the noise floor", spec)
+		}
+	}
+}
+
+// setFlags sets command-line flags for the rest of the test.
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		previous := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("setting -%s: %v", name, err)
+		}
+		t.Cleanup(func() { flag.Set(name, previous) })
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		flags   map[string]string
+		wantErr string            // Part of the error, if one is expected
+		want    map[string]string // Flag values after clamping
+	}{
+		{name: "defaults"},
+		{name: "auto threshold", flags: map[string]string{"threshold": "auto"}},
+		{name: "negative threshold", flags: map[string]string{"threshold": "-5"}, wantErr: "-threshold"},
+		{name: "threshold above int16", flags: map[string]string{"threshold": "40000"}, wantErr: "-threshold"},
+		{name: "threshold not a number", flags: map[string]string{"threshold": "quiet"}, wantErr: "-threshold"},
+		{name: "unknown output mode", flags: map[string]string{"output": "print"}, wantErr: "-output"},
+		{name: "zero crossing rate zero", flags: map[string]string{"zcr-threshold": "0"}, wantErr: "-zcr-threshold"},
+		{name: "zero crossing rate above one", flags: map[string]string{"zcr-threshold": "1.5"}, wantErr: "-zcr-threshold"},
+		{name: "zero gain", flags: map[string]string{"gain": "0"}, wantErr: "-gain"},
+		{name: "tiny chunk", flags: map[string]string{"chunk": "1ms"}, wantErr: "-chunk"},
+		{name: "huge chunk", flags: map[string]string{"chunk": "1m"}, wantErr: "-chunk"},
+		{name: "realtime manual flush", flags: map[string]string{"manual-flush": "true", "realtime": "true"}, wantErr: "-manual-flush"},
+		{
+			name:  "zero pause",
+			flags: map[string]string{"pause": "0s"},
+			want:  map[string]string{"pause": "100ms"},
+		},
+		{
+			name:  "sentence pause below pause",
+			flags: map[string]string{"pause": "800ms", "sentence-pause": "200ms"},
+			want:  map[string]string{"pause": "800ms", "sentence-pause": "800ms"},
+		},
+		{
+			name:  "max phrase below two chunks",
+			flags: map[string]string{"chunk": "1s", "max-phrase": "500ms"},
+			want:  map[string]string{"max-phrase": "2s"},
+		},
+		{
+			name:  "negative durations",
+			flags: map[string]string{"idle-timeout": "-1s", "key-delay": "-1ms"},
+			want:  map[string]string{"idle-timeout": "0s", "key-delay": minKeyDelay.String()},
+		},
+		{
+			name:  "counts below one",
+			flags: map[string]string{"stream-every": "0", "max-requests": "-3", "min-speech-chunks": "0", "overlap-words": "0"},
+			want:  map[string]string{"stream-every": "1", "max-requests": "1", "min-speech-chunks": "1", "overlap-words": "1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.flags)
+			err := validateFlags()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("validateFlags() error = %v, want one about %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateFlags() error = %v", err)
+			}
+			for name, want := range test.want {
+				if got := flag.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s = %s after validation, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimRepeated(t *testing.T) {
+	for _, test := range []struct {
+		carried, text, want string
+	}{
+		{"", "hello there", "hello there"},
+		{"the quick brown fox", "brown fox jumps", "jumps"},
+		{"the quick brown fox", "Fox, jumps over", "jumps over"},
+		{"the quick brown fox.", "fox", ""},
+		{"the quick brown fox", "jumps over", "jumps over"},
+		{"I am going to", "gonna say it", "say it"},
+	} {
+		if got := trimRepeated(strings.Fields(test.carried), test.text); got != test.want {
+			t.Errorf("trimRepeated(%q, %q) = %q, want %q", test.carried, test.text, got, test.want)
+		}
+	}
+}
+
+// TestSessionPhraseContext checks that with -phrase-context the end of a
+// phrase is sent again at the start of the next one, and the words it
+// repeats aren't typed twice.
+func TestSessionPhraseContext(t *testing.T) {
+	setFlags(t, map[string]string{"phrase-context": "true"})
+	typer := &recordingTyper{}
+	transcriber := &scriptedTranscriber{texts: []string{"the quick brown fox", "brown fox jumps over"}}
+	s, err := newSession(&Recorder{typer: typer, transcriber: transcriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range testChunks(time.Now(), "###....###....") {
+		s.handleChunk(context.Background(), chunk)
+	}
+	s.typer.Close()
+
+	chunk := audioConfig.samplesIn(100 * time.Millisecond)
+	overlap := audioConfig.samplesIn(chunkOverlap)
+	// Each phrase is its speech and the pause before it was flushed
+	want := []int{6 * chunk, overlap + 6*chunk}
+	var lengths []int
+	for _, samples := range transcriber.requests {
+		lengths = append(lengths, len(samples))
+	}
+	if !slices.Equal(lengths, want) {
+		t.Errorf("transcribed %v samples, want %v", lengths, want)
+	}
+	if want := []string{"The quick brown fox ", "jumps over "}; !slices.Equal(typer.output, want) {
+		t.Errorf("typed %q, want %q", typer.output, want)
+	}
+}
+
+// biased returns samples shifted by offset, as an interface with a DC bias
+// records them.
+func biased(samples []int16, offset int16) []int16 {
+	out := make([]int16, len(samples))
+	for i, sample := range samples {
+		out[i] = sample + offset
+	}
+	return out
+}
+
+// mean returns the average of samples.
+func mean(samples []int16) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample)
+	}
+	return sum / float64(len(samples))
+}
+
+func TestAudioFilterRemovesBias(t *testing.T) {
+	params := vadParams{energyThreshold: energyThreshold, zcrThreshold: zcrThreshold}
+	for _, test := range []struct {
+		name  string
+		data  []int16
+		voice bool
+	}{
+		{"biased silence", biased(whiteNoise(40, time.Second), 2000), false},
+		{"negative bias", biased(make([]int16, 16000), -3000), false},
+		{"biased speech", biased(sine(440, 3000, time.Second), 2000), true},
+	} {
+		filter := newAudioFilter(0, audioConfig)
+		filtered := filter.apply(test.data)
+		if got := detectVoiceActivity(filtered, params); got != test.voice {
+			t.Errorf("%s: voice activity after filtering = %v, want %v (energy %d)", test.name, got, test.voice, averageEnergy(filtered))
+		}
+		if m := mean(filtered); math.Abs(m) > 1 {
+			t.Errorf("%s: filtered mean = %.1f, want 0", test.name, m)
+		}
+	}
+}
+
+func TestAudioFilterHighPass(t *testing.T) {
+	for _, test := range []struct {
+		freq     float64
+		min, max float64 // Energy kept, as a fraction of the input's
+	}{
+		{30, 0.2, 0.5},
+		{1000, 0.95, 1.05},
+	} {
+		filter := newAudioFilter(80, audioConfig)
+		tone := sine(test.freq, 5000, time.Second)
+		filter.apply(tone) // Settle the filter state
+		kept := float64(averageEnergy(filter.apply(tone))) / float64(averageEnergy(tone))
+		if kept < test.min || kept > test.max {
+			t.Errorf("80Hz high-pass kept %.2f of a %vHz tone, want %.2f to %.2f", kept, test.freq, test.min, test.max)
+		}
+	}
+}
+
+// TestSessionFilterAudio checks that silence is detected on filtered audio
+// while the raw audio is sent unless -filter-audio is set.
+func TestSessionFilterAudio(t *testing.T) {
+	for _, filterAudio := range []bool{false, true} {
+		setFlags(t, map[string]string{"filter-audio": strconv.FormatBool(filterAudio)})
+		transcriber := &scriptedTranscriber{texts: []string{"hello"}}
+		s, err := newSession(&Recorder{typer: &recordingTyper{}, transcriber: transcriber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range testChunks(time.Now(), "###....") {
+			chunk.data = biased(chunk.data, 2000)
+			s.handleChunk(context.Background(), chunk)
+		}
+		s.typer.Close()
+
+		if len(transcriber.requests) != 1 {
+			t.Fatalf("-filter-audio=%v: transcribed %d phrases, want 1", filterAudio, len(transcriber.requests))
+		}
+		want := 2000.0
+		if filterAudio {
+			want = 0
+		}
+		if got := mean(transcriber.requests[0]); math.Abs(got-want) > 1 {
+			t.Errorf("-filter-audio=%v: transcribed audio has mean %.1f, want %.0f", filterAudio, got, want)
+		}
+	}
+}
+
+// TestMergeOverlapSpeechRate merges realtime chunks whose overlap repeats
+// a few words of slow speech or many of fast speech, transcribed slightly
+// differently the second time.
+func TestMergeOverlapSpeechRate(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		window      int // -overlap-words
+		words, next string
+		want        string
+	}{
+		{
+			name:   "slow speech",
+			window: 8,
+			words:  "so what I want",
+			next:   "want to say is",
+			want:   "so what I want to say is",
+		},
+		{
+			name:   "fast speech",
+			window: 8,
+			words:  "and then we went to the store and bought some",
+			next:   "to the store and bought some milk and eggs",
+			want:   "and then we went to the store and bought some milk and eggs",
+		},
+		{
+			name:   "fast speech beyond the window",
+			window: 3,
+			words:  "and then we went to the store and bought some",
+			next:   "to the store and bought some milk and eggs",
+			want:   "and then we went to the store and bought some to the store and bought some milk and eggs",
+		},
+		{
+			name:   "contraction",
+			window: 8,
+			words:  "I'm gonna",
+			next:   "going to finish this",
+			want:   "I'm gonna finish this",
+		},
+		{
+			name:   "misheard word",
+			window: 8,
+			words:  "we discussed the quarterly results",
+			next:   "the quarterly result today",
+			want:   "we discussed the quarterly results today",
+		},
+		{
+			name:   "accent differs",
+			window: 8,
+			words:  "we'll meet at the cafe",
+			next:   "at the café tomorrow",
+			want:   "we'll meet at the cafe tomorrow",
+		},
+		{
+			name:   "short words don't match fuzzily",
+			window: 8,
+			words:  "I know the",
+			next:   "they said",
+			want:   "I know the they said",
+		},
+	} {
+		setFlags(t, map[string]string{"overlap-words": strconv.Itoa(test.window)})
+		got := strings.Join(mergeOverlap(strings.Fields(test.words), strings.Fields(test.next)), " ")
+		if got != test.want {
+			t.Errorf("%s: mergeOverlap(%q, %q) = %q, want %q", test.name, test.words, test.next, got, test.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"quarterlyresults", "quarterlyresult", 1},
+	} {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestSessionOnset checks that a phrase only starts after -min-speech-chunks
+// consecutive chunks of sound, so isolated clicks aren't transcribed.
+func TestSessionOnset(t *testing.T) {
+	for _, test := range []struct {
+		minSpeech string
+		script    string
+		phrases   int
+	}{
+		{"2", "#.......", 0},
+		{"2", "#.#.#.#.......", 0},
+		{"2", "##....", 1},
+		{"2", "#..##....", 1},
+		{"3", "##.......", 0},
+		{"3", "###....", 1},
+		{"1", "#....", 1},
+		{"1", "#....#....", 2},
+	} {
+		setFlags(t, map[string]string{"min-speech-chunks": test.minSpeech})
+		transcriber := &scriptedTranscriber{texts: []string{"one", "two"}}
+		s, err := newSession(&Recorder{typer: &recordingTyper{}, transcriber: transcriber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range testChunks(time.Now(), test.script) {
+			s.handleChunk(context.Background(), chunk)
+		}
+		s.typer.Close()
+		if transcriber.calls != test.phrases {
+			t.Errorf("-min-speech-chunks=%s, %q: transcribed %d phrases, want %d",
+				test.minSpeech, test.script, transcriber.calls, test.phrases)
+		}
+	}
+}
+
+func TestChunkBytes(t *testing.T) {
+	stereo := AudioConfig{SampleRate: 44100, Channels: 2, BitsPerSample: 16}
+	for _, test := range []struct {
+		config   AudioConfig
+		duration time.Duration
+		want     int
+	}{
+		{audioConfig, time.Second, 32000},
+		{audioConfig, 500 * time.Millisecond, 16000},
+		{audioConfig, 250 * time.Millisecond, 8000},
+		{audioConfig, 20 * time.Millisecond, 640},
+		{audioConfig, 2500 * time.Millisecond, 80000},
+		{audioConfig, 0, 0},
+		// Rounded down to whole frames of both channels
+		{stereo, time.Second, 176400},
+		{stereo, 10 * time.Millisecond, 1764},
+		{stereo, 15*time.Millisecond + 10*time.Microsecond, 2644},
+	} {
+		got := test.config.chunkBytes(test.duration)
+		if got != test.want {
+			t.Errorf("chunkBytes(%v) at %d Hz with %d channels = %d, want %d",
+				test.duration, test.config.SampleRate, test.config.Channels, got, test.want)
+		}
+		if got%(test.config.Channels*2) != 0 {
+			t.Errorf("chunkBytes(%v) = %d, not whole frames", test.duration, got)
+		}
+	}
+}
+
+// referenceWav encodes samples the way writeWavToBuffer did before it wrote
+// them straight into the output: field by field through an intermediate
+// data buffer.
+func referenceWav(samples []int16, config AudioConfig) []byte {
+	var data bytes.Buffer
+	for _, sample := range samples {
+		binary.Write(&data, binary.LittleEndian, sample)
+	}
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(36+data.Len()))
+	out.WriteString("WAVEfmt ")
+	binary.Write(&out, binary.LittleEndian, uint32(16))
+	binary.Write(&out, binary.LittleEndian, uint16(1))
+	binary.Write(&out, binary.LittleEndian, uint16(config.Channels))
+	binary.Write(&out, binary.LittleEndian, uint32(config.SampleRate))
+	binary.Write(&out, binary.LittleEndian, uint32(config.bytesPerSecond()))
+	binary.Write(&out, binary.LittleEndian, uint16(config.Channels*config.BitsPerSample/8))
+	binary.Write(&out, binary.LittleEndian, uint16(config.BitsPerSample))
+	out.WriteString("data")
+	binary.Write(&out, binary.LittleEndian, uint32(data.Len()))
+	out.Write(data.Bytes())
+	return out.Bytes()
+}
+
+func TestWriteWavToBufferMatchesReference(t *testing.T) {
+	stereo := AudioConfig{SampleRate: 44100, Channels: 2, BitsPerSample: 16}
+	// A reused buffer, as wavBuffers hands out, holds old bytes past its length
+	var reused bytes.Buffer
+	reused.Write(bytes.Repeat([]byte{0xff}, 1<<16))
+	for _, test := range []struct {
+		config  AudioConfig
+		samples []int16
+	}{
+		{audioConfig, nil},
+		{audioConfig, []int16{0, 1, -1, math.MaxInt16, math.MinInt16}},
+		{audioConfig, sine(440, 10000, time.Second)},
+		{stereo, interleavedTone(44100, []float64{8000, -3000}, 100*time.Millisecond)},
+	} {
+		reused.Reset()
+		if err := writeWavToBuffer(&reused, test.samples, test.config); err != nil {
+			t.Fatalf("writeWavToBuffer() error = %v", err)
+		}
+		if want := referenceWav(test.samples, test.config); !bytes.Equal(reused.Bytes(), want) {
+			t.Errorf("writeWavToBuffer(%d samples) differs from the reference encoding", len(test.samples))
+		}
+	}
+}
+
+// syntheticWav returns a mono 8kHz WAV file of data in the given encoding.
+// An extensible file names the encoding in its fmt extension, and a LIST
+// chunk before the data is skipped by readers.
+func syntheticWav(encoding uint16, bits int, data []byte, extensible bool) []byte {
+	fmtChunk := binary.LittleEndian.AppendUint16(nil, encoding)
+	if extensible {
+		fmtChunk = binary.LittleEndian.AppendUint16(nil, wavFormatExtensible)
+	}
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 1)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 8000)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(8000*bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+	if extensible {
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 22)
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+		fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 4) // Front center
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, encoding)
+		fmtChunk = append(fmtChunk, make([]byte, 14)...) // Rest of the subformat GUID
+	}
+
+	var chunks []byte
+	for _, chunk := range []struct {
+		id   string
+		body []byte
+	}{{"fmt ", fmtChunk}, {"LIST", []byte("odd")}, {"data", data}} {
+		chunks = append(chunks, chunk.id...)
+		chunks = binary.LittleEndian.AppendUint32(chunks, uint32(len(chunk.body)))
+		chunks = append(chunks, chunk.body...)
+		if len(chunk.body)%2 == 1 {
+			chunks = append(chunks, 0)
+		}
+	}
+	file := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(chunks)))...)
+	return append(append(file, "WAVE"...), chunks...)
+}
+
+func TestReadWavFile(t *testing.T) {
+	// Each file holds silence, half scale up and down, and full scale up
+	// and down
+	float32s := func(values ...float32) []byte {
+		var data []byte
+		for _, value := range values {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(value))
+		}
+		return data
+	}
+	float64s := func(values ...float64) []byte {
+		var data []byte
+		for _, value := range values {
+			data = binary.LittleEndian.AppendUint64(data, math.Float64bits(value))
+		}
+		return data
+	}
+	for _, test := range []struct {
+		name       string
+		encoding   uint16
+		bits       int
+		data       []byte
+		extensible bool
+		want       []int16
+	}{
+		{"8-bit", wavFormatPCM, 8, []byte{128, 192, 64, 255, 0}, false, []int16{0, 16384, -16384, 32512, -32768}},
+		{"16-bit", wavFormatPCM, 16, []byte{0, 0, 0, 0x40, 0, 0xc0, 0xff, 0x7f, 0, 0x80}, false, []int16{0, 16384, -16384, 32767, -32768}},
+		{"24-bit", wavFormatPCM, 24, []byte{0, 0, 0, 0x12, 0, 0x40, 0x34, 0, 0xc0, 0xff, 0xff, 0x7f, 0, 0, 0x80}, false, []int16{0, 16384, -16384, 32767, -32768}},
+		{"32-bit", wavFormatPCM, 32, []byte{0, 0, 0, 0, 0, 0x12, 0, 0x40, 0, 0x34, 0, 0xc0, 0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0x80}, false, []int16{0, 16384, -16384, 32767, -32768}},
+		{"32-bit float", wavFormatFloat, 32, float32s(0, 0.5, -0.5, 1, -1), false, []int16{0, 16384, -16384, 32767, -32767}},
+		{"64-bit float", wavFormatFloat, 64, float64s(0, 0.5, -0.5, 2, math.NaN()), false, []int16{0, 16384, -16384, 32767, 0}},
+		{"extensible 24-bit", wavFormatPCM, 24, []byte{0, 0, 0, 0, 0, 0x40}, true, []int16{0, 16384}},
+		{"extensible float", wavFormatFloat, 32, float32s(0.5, -0.5), true, []int16{16384, -16384}},
+	} {
+		path := filepath.Join(t.TempDir(), "test.wav")
+		if err := os.WriteFile(path, syntheticWav(test.encoding, test.bits, test.data, test.extensible), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		samples, format, err := readWavFile(path)
+		if err != nil {
+			t.Errorf("%s: readWavFile() error = %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(samples, test.want) {
+			t.Errorf("%s: readWavFile() samples = %v, want %v", test.name, samples, test.want)
+		}
+		if want := (AudioConfig{SampleRate: 8000, Channels: 1, BitsPerSample: 16}); format != want {
+			t.Errorf("%s: readWavFile() format = %+v, want %+v", test.name, format, want)
+		}
+	}
+}
+
+func TestReadWavFileUnsupported(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		encoding uint16
+		bits     int
+	}{
+		{"12-bit", wavFormatPCM, 12},
+		{"16-bit float", wavFormatFloat, 16},
+		{"A-law", 6, 8},
+	} {
+		path := filepath.Join(t.TempDir(), "test.wav")
+		if err := os.WriteFile(path, syntheticWav(test.encoding, test.bits, make([]byte, 8), false), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readWavFile(path); err == nil {
+			t.Errorf("%s: readWavFile() succeeded, want an error", test.name)
+		}
+	}
+}
+
+// testConfigPath points the config file at a temporary directory for the
+// rest of the test and returns its path.
+func testConfigPath(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	path, err := configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigCreatesEmptyFile(t *testing.T) {
+	path := testConfigPath(t)
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{}\n" {
+		t.Errorf("created config %q, want an empty object", data)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := testConfigPath(t)
+	setFlags(t, map[string]string{"language": "", "pause": silenceDuration.String(), "phrase-context": "false",
+		"token": "", "file": "", "once": "false"})
+	config := `{"language": "de", "pause": "450ms", "phrase-context": true, "token": "secret",
+		"file": "note.wav", "once": true, "removed-option": 1}`
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig() error = %v, want unknown options skipped", err)
+	}
+	for name, want := range map[string]string{
+		"language": "de", "pause": "450ms", "phrase-context": "true",
+		// One-shot actions and secrets are ignored
+		"token": "", "file": "", "once": "false",
+	} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q after loading the config, want %q", name, got, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"pause": "soon"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err == nil {
+		t.Errorf("loadConfig() with an invalid value succeeded, want an error")
+	}
+}
+
+// TestControlRequiresJSON checks that the control endpoints refuse the
+// form posts any web page could send, and accept JSON requests.
+func TestControlRequiresJSON(t *testing.T) {
+	server := httptest.NewServer(apiHandler(&Recorder{}))
+	defer server.Close()
+	for _, path := range []string{"/toggle", "/undo", "/pause", "/safe", "/flush"} {
+		for _, contentType := range []string{"", "application/x-www-form-urlencoded", "text/plain"} {
+			resp, err := http.Post(server.URL+path, contentType, strings.NewReader("a=b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnsupportedMediaType {
+				t.Errorf("POST %s with %q = %d, want %d", path, contentType, resp.StatusCode, http.StatusUnsupportedMediaType)
+			}
+		}
+	}
+	// Inactive, so these only report the status
+	for _, path := range []string{"/pause", "/flush"} {
+		resp, err := http.Post(server.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("JSON POST %s = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// TestSessionCommitCancelsInterim checks that ending a phrase doesn't wait
+// for a slow interim transcription holding the only request slot.
+func TestSessionCommitCancelsInterim(t *testing.T) {
+	setFlags(t, map[string]string{"streaming": "true", "stream-every": "1", "max-requests": "1", "manual-flush": "true"})
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			// The interim only ends when canceled
+			started <- struct{}{}
+			select {
+			case <-req.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		fmt.Fprint(w, `{"text": "hello there"}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	typer := &recordingTyper{}
+	s, err := newSession(&Recorder{typer: typer, transcriber: testClient(server)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range testChunks(time.Now(), "####") {
+		s.handleChunk(context.Background(), chunk)
+	}
+	<-started
+
+	start := time.Now()
+	s.flush(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("flush() took %v, want it not to wait for the interim", elapsed)
+	}
+	if result := <-s.interimResults; !errors.Is(result.err, context.Canceled) {
+		t.Errorf("interim error = %v, want context.Canceled", result.err)
+	}
+	s.typer.Close()
+	if len(typer.output) == 0 || typer.output[0] != "Hello there " {
+		t.Errorf("typed %q, want the phrase first", typer.output)
+	}
+}
+
+// fakeStream is a StreamingTranscriber that answers Finish with a final
+// result and calls onSend after each chunk it is sent.
+type fakeStream struct {
+	results chan StreamResult
+	final   string
+	sent    int
+	onSend  func(sent int)
+}
+
+func (f *fakeStream) Transcribe(ctx context.Context, samples []int16) (string, error) {
+	return f.final, nil
+}
+
+func (f *fakeStream) Send(samples []int16) error {
+	f.sent++
+	f.onSend(f.sent)
+	return nil
+}
+
+func (f *fakeStream) Finish() error {
+	f.results <- StreamResult{Text: f.final, Final: true}
+	return nil
+}
+
+func (f *fakeStream) Results() <-chan StreamResult {
+	return f.results
+}
+
+// TestRunStreamingLeftovers checks that a streaming session ignores a final
+// result left over from the previous one, and finalizes audio it sent
+// before any interim result arrived.
+func TestRunStreamingLeftovers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeStream{results: make(chan StreamResult, 4), final: "hello there"}
+	// Stop once both chunks were sent, with no interim result shown
+	stream.onSend = func(sent int) {
+		if sent == 2 {
+			cancel()
+		}
+	}
+	stream.results <- StreamResult{Text: "late from last time", Final: true}
+
+	typer := &recordingTyper{}
+	recorder := &Recorder{typer: typer, transcriber: stream}
+	recorder.source = func(ctx context.Context, audioChan chan<- AudioChunk) {
+		for _, chunk := range testChunks(time.Now(), "##") {
+			audioChan <- chunk
+		}
+		<-ctx.Done()
+		close(audioChan)
+	}
+	if err := runStreaming(ctx, recorder, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(typer.output) == 0 || typer.output[0] != "Hello there " {
+		t.Errorf("typed %q, want only the final of this session", typer.output)
+	}
+}
+
+// TestProfileKeyGap checks that a profile sets the pause between keys as
+// well as how long they are held, and that the slowdown after dropped
+// keystrokes comes on top of it.
+func TestProfileKeyGap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(`[{"match": "vnc", "keyDelay": "20ms", "keyGap": "30ms"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { typingProfiles = nil })
+	if err := loadProfiles(path); err != nil {
+		t.Fatal(err)
+	}
+	settings := typingProfiles[0].apply(defaultSettings())
+	if settings.keyDelay != 20*time.Millisecond || settings.keyGap != 30*time.Millisecond {
+		t.Errorf("profile key delay and gap = %v, %v; want 20ms, 30ms", settings.keyDelay, settings.keyGap)
+	}
+
+	typingSlowdown.Store(int64(10 * time.Millisecond))
+	t.Cleanup(func() { typingSlowdown.Store(0) })
+	if got := settings.gap(); got != 40*time.Millisecond {
+		t.Errorf("gap() = %v, want the profile's 30ms plus a 10ms slowdown", got)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// numberSeparators are the thousands and decimal separators of a locale.
+type numberSeparators struct {
+	thousands string
+	decimal   string
+}
+
+// numberLocales maps -number-locale values to their separators. French
+// style groups thousands with a narrow no-break space.
+var numberLocales = map[string]numberSeparators{
+	"en": {",", "."},
+	"de": {".", ","},
+	"es": {".", ","},
+	"it": {".", ","},
+	"nl": {".", ","},
+	"pt": {".", ","},
+	"fr": {"\u202f", ","},
+	"pl": {"\u202f", ","},
+	"ru": {"\u202f", ","},
+	"sv": {"\u202f", ","},
+}
+
+// numberWords are the values of the English number words formatNumbers
+// understands, apart from the scales in numberScales.
+var numberWords = map[string]int{
+	"zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5,
+	"six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10,
+	"eleven": 11, "twelve": 12, "thirteen": 13, "fourteen": 14, "fifteen": 15,
+	"sixteen": 16, "seventeen": 17, "eighteen": 18, "nineteen": 19,
+	"twenty": 20, "thirty": 30, "forty": 40, "fifty": 50,
+	"sixty": 60, "seventy": 70, "eighty": 80, "ninety": 90,
+}
+
+var numberScales = map[string]int{
+	"hundred":  100,
+	"thousand": 1000,
+	"million":  1000000,
+	"billion":  1000000000,
+}
+
+// groupingThreshold is the smallest number formatNumbers groups into
+// thousands, so four-digit numbers such as years stay as they are.
+const groupingThreshold = 10000
+
+// formatNumbers replaces spoken English numbers in text with digits, using
+// the separators of locale. It is deliberately conservative: single words
+// from zero to nine are left alone, as prose usually spells them out, and
+// so is any run of number words that doesn't read as one number, such as
+// "nineteen eighty four" or "two and three".
+func formatNumbers(text, locale string) string {
+	separators, ok := numberLocales[locale]
+	if !ok {
+		separators = numberLocales["en"]
+	}
+
+	words := strings.Fields(text)
+	var out []string
+	for i := 0; i < len(words); {
+		n := numberRunAt(words[i:])
+		if n == 0 {
+			out = append(out, words[i])
+			i++
+			continue
+		}
+		run := words[i : i+n]
+		if formatted, ok := parseNumber(run, separators); ok {
+			out = append(out, formatted+trailingPunct(run[n-1]))
+		} else {
+			out = append(out, run...)
+		}
+		i += n
+	}
+	return strings.Join(out, " ")
+}
+
+// numberRunAt returns how many leading words of words form a run of number
+// words, including "and" and "point" between them. Punctuation after a word
+// ends the run there.
+func numberRunAt(words []string) int {
+	n := 0
+	for n < len(words) {
+		word := numberWord(words[n])
+		switch {
+		case isNumberWord(word):
+		case (word == "and" || word == "point") && n > 0 && n+1 < len(words) &&
+			trailingPunct(words[n-1]) == "" && isNumberWord(numberWord(words[n+1])):
+		default:
+			return n
+		}
+		n++
+		if trailingPunct(words[n-1]) != "" {
+			return n
+		}
+	}
+	return n
+}
+
+// isNumberWord reports whether word, a hyphenated compound such as
+// "twenty-five" included, is made of number words.
+func isNumberWord(word string) bool {
+	for _, part := range strings.Split(word, "-") {
+		if _, ok := numberWords[part]; !ok && numberScales[part] == 0 {
+			return false
+		}
+	}
+	return word != ""
+}
+
+// numberWord returns word lowercased without trailing punctuation.
+func numberWord(word string) string {
+	return strings.ToLower(strings.TrimRight(word, closingPunctuation))
+}
+
+// trailingPunct returns the punctuation at the end of word.
+func trailingPunct(word string) string {
+	return word[len(strings.TrimRight(word, closingPunctuation)):]
+}
+
+// parseNumber reads run, a run found by numberRunAt, as one number and
+// formats it. It fails when the words don't form a single number or form
+// a lone digit word.
+func parseNumber(run []string, separators numberSeparators) (string, bool) {
+	var parts []string
+	for _, word := range run {
+		parts = append(parts, strings.Split(numberWord(word), "-")...)
+	}
+
+	integer, fraction := parts, []string(nil)
+	for i, part := range parts {
+		if part == "point" {
+			integer, fraction = parts[:i], parts[i+1:]
+			break
+		}
+	}
+
+	value, ok := parseInteger(integer)
+	if !ok {
+		return "", false
+	}
+	if len(integer) == 1 && value < 10 && fraction == nil {
+		return "", false
+	}
+
+	formatted := groupThousands(value, separators.thousands)
+	if fraction == nil {
+		return formatted, true
+	}
+	var digits strings.Builder
+	for _, part := range fraction {
+		digit, ok := numberWords[part]
+		if !ok || digit > 9 {
+			return "", false
+		}
+		digits.WriteString(strconv.Itoa(digit))
+	}
+	return formatted + separators.decimal + digits.String(), true
+}
+
+// parseInteger reads words as a whole number in the usual English order,
+// such as "three hundred and five" or "twelve thousand forty". It fails on
+// words that don't continue the number they follow, and on a "zero" that
+// isn't the whole number.
+func parseInteger(words []string) (int, bool) {
+	const (
+		none = iota
+		unit
+		teen
+		tens
+		hundred
+		scale
+		and
+	)
+	var total, current int
+	last := none
+	lastScale := 0
+	for _, word := range words {
+		if word == "and" {
+			if last != hundred && last != scale {
+				return 0, false
+			}
+			last = and
+			continue
+		}
+		if word == "zero" {
+			if len(words) != 1 {
+				return 0, false
+			}
+			return 0, true
+		}
+
+		if value, ok := numberWords[word]; ok {
+			kind := unit
+			switch {
+			case value >= 20:
+				kind = tens
+			case value >= 10:
+				kind = teen
+			}
+			allowed := last == none || last == hundred || last == scale || last == and ||
+				kind == unit && last == tens
+			if !allowed {
+				return 0, false
+			}
+			current += value
+			last = kind
+			continue
+		}
+
+		size := numberScales[word]
+		if size == 100 {
+			// "twelve hundred" is common; "twenty hundred" isn't a number
+			if (last != unit && last != teen) || current >= 100 {
+				return 0, false
+			}
+			current *= 100
+			last = hundred
+			continue
+		}
+		if current == 0 || last == and || lastScale != 0 && size >= lastScale {
+			return 0, false
+		}
+		total += current * size
+		current = 0
+		last = scale
+		lastScale = size
+	}
+	if last == and || last == none {
+		return 0, false
+	}
+	return total + current, true
+}
+
+// groupThousands formats value with sep between groups of three digits,
+// once it reaches groupingThreshold.
+func groupThousands(value int, sep string) string {
+	digits := strconv.Itoa(value)
+	if value < groupingThreshold {
+		return digits
+	}
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// validateNumberLocale returns an error unless locale is a -number-locale
+// formatNumbers knows.
+func validateNumberLocale(locale string) error {
+	if _, ok := numberLocales[locale]; !ok {
+		return fmt.Errorf("unknown -number-locale %q", locale)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestFormatNumbers(t *testing.T) {
+	for _, test := range []struct {
+		locale string
+		text   string
+		want   string
+	}{
+		// Numbers in prose
+		{"en", "it costs three hundred dollars", "it costs 300 dollars"},
+		{"en", "I have twenty-five apples.", "I have 25 apples."},
+		{"en", "add three hundred and five items", "add 305 items"},
+		{"en", "Twelve hundred people came", "1200 people came"},
+		{"en", "about forty two thousand and twelve, roughly", "about 42,012, roughly"},
+		{"en", "ten thousand five hundred", "10,500"},
+		{"en", "two million three hundred thousand", "2,300,000"},
+		{"en", "pi is three point one four", "pi is 3.14"},
+		{"en", "it was twenty five percent?", "it was 25 percent?"},
+		{"en", "zero", "zero"},
+		{"en", "Zero point five", "0.5"},
+
+		// Left alone: single digit words, and runs that aren't one number
+		{"en", "one of the two options", "one of the two options"},
+		{"en", "nineteen eighty four", "nineteen eighty four"},
+		{"en", "two and three", "two and three"},
+		{"en", "twenty hundred", "twenty hundred"},
+		{"en", "a hundred things", "a hundred things"},
+		{"en", "the point is ten", "the point is 10"},
+		{"en", "hundreds of people", "hundreds of people"},
+		{"en", "eleven, twelve", "11, 12"},
+		{"en", "three point", "three point"},
+		{"en", "no numbers here", "no numbers here"},
+
+		// Locale separators
+		{"de", "fünf Stück kosten twelve thousand three hundred point five", "fünf Stück kosten 12.300,5"},
+		{"fr", "twelve thousand three hundred point five", "12 300,5"},
+		{"sv", "one million", "1 000 000"},
+		{"xx", "twelve thousand three hundred", "12,300"},
+	} {
+		if got := formatNumbers(test.text, test.locale); got != test.want {
+			t.Errorf("formatNumbers(%q, %s) = %q, want %q", test.text, test.locale, got, test.want)
+		}
+	}
+}
+
+func TestValidateNumberLocale(t *testing.T) {
+	for locale := range numberLocales {
+		if err := validateNumberLocale(locale); err != nil {
+			t.Errorf("validateNumberLocale(%q) error = %v", locale, err)
+		}
+	}
+	for _, locale := range []string{"", "EN", "en_US"} {
+		if err := validateNumberLocale(locale); err == nil {
+			t.Errorf("validateNumberLocale(%q) succeeded, want an error", locale)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// TypingProfile overrides typing settings for windows whose WM_CLASS
+// instance or class name matches Match. Unset fields keep the flag values.
+type TypingProfile struct {
+	Match         string `json:"match"`
+	TrailingSpace *bool  `json:"trailingSpace,omitempty"`
+	KeyDelay      string `json:"keyDelay,omitempty"`
+	KeyGap        string `json:"keyGap,omitempty"`
+	Commands      *bool  `json:"commands,omitempty"`
+	Verify        *bool  `json:"verify,omitempty"`
+
+	match    *regexp.Regexp
+	keyDelay time.Duration
+	keyGap   time.Duration
+}
+
+// typingSettings are the effective settings for the focused window.
+type typingSettings struct {
+	profile       string // Match of the applied profile, empty for defaults
+	trailingSpace bool
+	keyDelay      time.Duration
+	keyGap        time.Duration
+	commands      bool // Whether spoken commands run or are typed literally
+	verify        bool // Whether typed phrases are read back, see -verify-typing
+}
+
+var (
+	// typingProfiles are loaded from -profiles and tried in order.
+	typingProfiles []*TypingProfile
+	// activeSettings is set by selectProfile before each phrase is typed
+	// and read by the typing backends on the TypingQueue goroutine.
+	activeSettings atomic.Pointer[typingSettings]
+)
+
+// loadProfiles reads a JSON array of typing profiles from path.
+func loadProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading profiles file: %w", err)
+	}
+	var profiles []*TypingProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("parsing profiles file: %w", err)
+	}
+	for i, profile := range profiles {
+		profile.match, err = regexp.Compile(profile.Match)
+		if err != nil {
+			return fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		if profile.KeyDelay != "" {
+			profile.keyDelay, err = time.ParseDuration(profile.KeyDelay)
+			if err != nil {
+				return fmt.Errorf("profile %q: key delay: %w", profile.Match, err)
+			}
+			profile.keyDelay = max(profile.keyDelay, minKeyDelay)
+		}
+		if profile.KeyGap != "" {
+			profile.keyGap, err = time.ParseDuration(profile.KeyGap)
+			if err != nil {
+				return fmt.Errorf("profile %q: key gap: %w", profile.Match, err)
+			}
+			profile.keyGap = max(profile.keyGap, minKeyDelay)
+		}
+	}
+	typingProfiles = profiles
+	return nil
+}
+
+// defaultSettings returns the settings given by flags.
+func defaultSettings() typingSettings {
+	return typingSettings{
+		trailingSpace: !*noTrailing,
+		keyDelay:      *keyDelay,
+		keyGap:        *keyGap,
+		commands:      true,
+		verify:        *verifyType,
+	}
+}
+
+// currentSettings returns the settings for the window being typed into.
+func currentSettings() typingSettings {
+	if settings := activeSettings.Load(); settings != nil {
+		return *settings
+	}
+	return defaultSettings()
+}
+
+// gap returns the pause after each keystroke: the key gap plus the
+// slowdown -verify-typing adds after dropped keystrokes.
+func (s typingSettings) gap() time.Duration {
+	return s.keyGap + time.Duration(typingSlowdown.Load())
+}
+
+// selectProfile applies the first profile matching the focused window's
+// WM_CLASS. It falls back to the defaults when typer can't report the
+// focused window or no profile matches.
+func selectProfile(typer TextTyper) {
+	if len(typingProfiles) == 0 {
+		return
+	}
+
+	settings := defaultSettings()
+	if window, ok := typer.(interface {
+		FocusedClass() (string, string, error)
+	}); ok {
+		instance, class, err := window.FocusedClass()
+		if err != nil {
+			debugf("Using default typing profile: %v", err)
+		}
+		for _, profile := range typingProfiles {
+			if err == nil && (profile.match.MatchString(instance) || profile.match.MatchString(class)) {
+				settings = profile.apply(settings)
+				break
+			}
+		}
+	}
+
+	if previous := activeSettings.Swap(&settings); previous == nil || previous.profile != settings.profile {
+		if settings.profile == "" {
+			log.Printf("Using default typing profile")
+		} else {
+			log.Printf("Using typing profile %q", settings.profile)
+		}
+	}
+}
+
+// apply returns settings with the profile's overrides.
+func (p *TypingProfile) apply(settings typingSettings) typingSettings {
+	settings.profile = p.Match
+	if p.TrailingSpace != nil {
+		settings.trailingSpace = *p.TrailingSpace
+	}
+	if p.KeyDelay != "" {
+		settings.keyDelay = p.keyDelay
+	}
+	if p.KeyGap != "" {
+		settings.keyGap = p.keyGap
+	}
+	if p.Commands != nil {
+		settings.commands = *p.Commands
+	}
+	if p.Verify != nil {
+		settings.verify = *p.Verify
+	}
+	return settings
+}
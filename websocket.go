@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Websocket opcodes from RFC 6455.
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+// wsMaxMessage bounds the size of a message read from the server.
+const wsMaxMessage = 1 << 20
+
+// wsConn is a minimal RFC 6455 client connection: enough to send frames and
+// read unfragmented or fragmented messages, without extensions.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// dialWebsocket opens a ws:// or wss:// connection, sending header with the
+// upgrade request.
+func dialWebsocket(rawURL string, header http.Header) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing websocket URL: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", hostWithPort(u, "80"))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(u, "443"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q (expected ws or wss)", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", u.Host, err)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("generating websocket key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending websocket handshake: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading websocket handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+	accept := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: bad Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &wsConn{conn: conn, reader: reader}, nil
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// WriteFrame sends payload as a single masked frame, as clients must.
+func (c *wsConn) WriteFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return fmt.Errorf("generating frame mask: %w", err)
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// joining fragments. It returns io.EOF once the server closes the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return nil, err
+		}
+		final := head[0]&0x80 != 0
+		opcode := head[0] & 0x0f
+
+		length := uint64(head[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if length > wsMaxMessage || uint64(len(message))+length > wsMaxMessage {
+			return nil, fmt.Errorf("websocket message exceeds %d bytes", wsMaxMessage)
+		}
+
+		var mask [4]byte
+		masked := head[1]&0x80 != 0
+		if masked {
+			if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsClose:
+			c.WriteFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsPing:
+			if err := c.WriteFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		}
+
+		message = append(message, payload...)
+		if final {
+			return message, nil
+		}
+	}
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	c.WriteFrame(wsClose, nil)
+	return c.conn.Close()
+}
+
+// WebsocketTranscriber streams raw capture-format PCM to a websocket server
+// as binary frames. The server answers with text frames holding JSON
+// {"text": ..., "final": bool}; a {"type": "end"} text frame asks it to
+// finalize the utterance in progress. The connection is kept open across
+// recording sessions and redialed after it fails.
+type WebsocketTranscriber struct {
+	url     string
+	results chan StreamResult
+
+	mu   sync.Mutex
+	conn *wsConn
+}
+
+func newWebsocketTranscriber(rawURL string) (*WebsocketTranscriber, error) {
+	w := &WebsocketTranscriber{url: rawURL, results: make(chan StreamResult, 16)}
+	if _, err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// connect returns the open connection, dialing a new one if needed.
+func (w *WebsocketTranscriber) connect() (*wsConn, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		return w.conn, nil
+	}
+
+	header := http.Header{}
+	if *apiToken != "" {
+		header.Set("Authorization", "Bearer "+*apiToken)
+	}
+	conn, err := dialWebsocket(w.url, header)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to streaming server %s", w.url)
+	w.conn = conn
+	go w.readResults(conn)
+	return conn, nil
+}
+
+// readResults forwards server messages to w.results until conn fails.
+// Between sessions nobody reads them, so once the buffer is full results
+// are dropped rather than blocking the replies to the server's pings.
+func (w *WebsocketTranscriber) readResults(conn *wsConn) {
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Streaming connection closed: %v", err)
+			}
+			w.drop(conn)
+			return
+		}
+
+		var result struct {
+			Text  string `json:"text"`
+			Final bool   `json:"final"`
+		}
+		if err := json.Unmarshal(message, &result); err != nil {
+			log.Printf("Ignoring malformed streaming message: %v", err)
+			continue
+		}
+		select {
+		case w.results <- StreamResult{Text: result.Text, Final: result.Final}:
+		default:
+			log.Printf("Dropping streaming result %q, no session is reading them", result.Text)
+		}
+	}
+}
+
+// drop closes conn and forgets it so the next call redials.
+func (w *WebsocketTranscriber) drop(conn *wsConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	conn.Close()
+	if w.conn == conn {
+		w.conn = nil
+	}
+}
+
+func (w *WebsocketTranscriber) Send(samples []int16) error {
+	conn, err := w.connect()
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 0, len(samples)*2)
+	for _, sample := range samples {
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(sample))
+	}
+	if err := conn.WriteFrame(wsBinary, payload); err != nil {
+		w.drop(conn)
+		return fmt.Errorf("sending audio: %w", err)
+	}
+	return nil
+}
+
+func (w *WebsocketTranscriber) Finish() error {
+	conn, err := w.connect()
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteFrame(wsText, []byte(`{"type":"end"}`)); err != nil {
+		w.drop(conn)
+		return fmt.Errorf("ending utterance: %w", err)
+	}
+	return nil
+}
+
+func (w *WebsocketTranscriber) Results() <-chan StreamResult {
+	return w.results
+}
+
+// Transcribe streams samples as a complete utterance and waits for its final
+// text.
+func (w *WebsocketTranscriber) Transcribe(ctx context.Context, samples []int16) (string, error) {
+	drainResults(w.results)
+	if err := w.Send(samples); err != nil {
+		return "", err
+	}
+	if err := w.Finish(); err != nil {
+		return "", err
+	}
+
+	timeout := time.After(requestTimeout(audioConfig, len(samples)))
+	for {
+		select {
+		case result := <-w.results:
+			if result.Final {
+				return result.Text, nil
+			}
+		case <-timeout:
+			return "", fmt.Errorf("timed out waiting for final transcription")
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tuning holds the recording settings /config can change while running.
+type tuning struct {
+	threshold     string // -threshold: a number or auto
+	pause         time.Duration
+	sentencePause time.Duration
+}
+
+// TuningConfig is the JSON form of tuning served and accepted by /config.
+// Durations use Go syntax such as "800ms"; empty fields in a POST are left
+// unchanged.
+type TuningConfig struct {
+	Threshold     string `json:"threshold"`
+	Pause         string `json:"pause"`
+	SentencePause string `json:"sentencePause"`
+}
+
+var (
+	// liveTuning is set by /config and read by run for each chunk. Until
+	// the first change the flags apply.
+	liveTuning atomic.Pointer[tuning]
+	// tuningMu serializes /config updates, which read and then replace
+	// liveTuning.
+	tuningMu sync.Mutex
+)
+
+// currentTuning returns the recording settings in effect.
+func currentTuning() tuning {
+	if t := liveTuning.Load(); t != nil {
+		return *t
+	}
+	return tuning{threshold: *threshold, pause: *pause, sentencePause: *sentPause}
+}
+
+// config returns t in its JSON form.
+func (t tuning) config() TuningConfig {
+	return TuningConfig{
+		Threshold:     t.threshold,
+		Pause:         t.pause.String(),
+		SentencePause: t.sentencePause.String(),
+	}
+}
+
+// apply returns t with the fields set in c, checked like the flags they
+// correspond to. A change is rejected rather than clamped, so the caller
+// sees what was wrong.
+func (t tuning) apply(c TuningConfig) (tuning, error) {
+	if c.Threshold != "" {
+		if err := validateThreshold(c.Threshold); err != nil {
+			return t, fmt.Errorf("invalid threshold: %w", err)
+		}
+		t.threshold = c.Threshold
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"pause", c.Pause, &t.pause},
+		{"sentencePause", c.SentencePause, &t.sentencePause},
+	} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return t, fmt.Errorf("invalid %s: %w", field.name, err)
+		}
+		*field.dst = d
+	}
+	if t.pause < minPause {
+		return t, fmt.Errorf("invalid pause %v: must be at least %v", t.pause, minPause)
+	}
+	if t.sentencePause < t.pause {
+		return t, fmt.Errorf("invalid sentencePause %v: must be at least the pause, %v", t.sentencePause, t.pause)
+	}
+	return t, nil
+}
+
+// serveConfig handles /config: GET returns the recording settings in
+// effect and POST changes them. POST only accepts a JSON body, which
+// browsers won't send to another site without asking it first, so other
+// pages can't change settings behind the user's back.
+func serveConfig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeConfig(w, currentTuning())
+	case http.MethodPost:
+		if !isJSONRequest(req) {
+			http.Error(w, "expected a JSON body", http.StatusUnsupportedMediaType)
+			return
+		}
+		var change TuningConfig
+		decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4<<10))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&change); err != nil {
+			http.Error(w, fmt.Sprintf("parsing config: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		tuningMu.Lock()
+		defer tuningMu.Unlock()
+		updated, err := currentTuning().apply(change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		liveTuning.Store(&updated)
+		log.Printf("Config changed: threshold %s, pause %v, sentence pause %v",
+			updated.threshold, updated.pause, updated.sentencePause)
+		writeConfig(w, updated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// isJSONRequest reports whether req declares a JSON body. Browsers only
+// send that cross-site after a preflight this server never answers.
+func isJSONRequest(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+func writeConfig(w http.ResponseWriter, t tuning) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.config()); err != nil {
+		log.Printf("Failed to write config: %v", err)
+	}
+}
+
+// serveWebUI returns the handler for the embedded web UI page, which polls
+// /status and drives the other endpoints.
+func serveWebUI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write(webUI)
+	})
+}